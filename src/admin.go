@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// AdminAPI exposes live sessions and the auth cache over HTTP.
+// On TCP every request must carry "Authorization: Bearer <Token>";
+// the Unix control socket relies on filesystem permissions instead.
+type AdminAPI struct {
+	Token       string
+	Server      *socks5.Server
+	Credentials *RadiusCredentials
+	Usage       *UsageAggregator
+	StartTime   time.Time
+	// Reload re-applies the runtime configuration
+	Reload func() error
+}
+
+type adminStatus struct {
+	StartTime   time.Time `json:"start_time"`
+	Uptime      string    `json:"uptime"`
+	Sessions    int       `json:"sessions"`
+	Users       int       `json:"users"`
+	CachedUsers int       `json:"cached_users"`
+}
+
+type adminSession struct {
+	ID          uint64    `json:"id"`
+	User        string    `json:"user"`
+	Client      string    `json:"client"`
+	Destination string    `json:"destination"`
+	Listener    string    `json:"listener,omitempty"`
+	StartTime   time.Time `json:"start_time"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+}
+
+type adminCacheEntry struct {
+	User      string    `json:"user"`
+	LastUsed  time.Time `json:"last_used"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (a *AdminAPI) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", a.status)
+	mux.HandleFunc("POST /reload", a.reload)
+	mux.HandleFunc("POST /accounting", a.runAccounting)
+	mux.HandleFunc("GET /usage", a.usage)
+	mux.HandleFunc("GET /sessions", a.listSessions)
+	mux.HandleFunc("DELETE /sessions/{id}", a.killSession)
+	mux.HandleFunc("DELETE /users/{user}/sessions", a.killUserSessions)
+	mux.HandleFunc("GET /auth-cache", a.listCache)
+	mux.HandleFunc("DELETE /auth-cache", a.flushCache)
+	mux.HandleFunc("DELETE /auth-cache/{user}", a.flushCache)
+	return mux
+}
+
+// Handler returns the token-protected handler for the TCP admin API
+func (a *AdminAPI) Handler() http.Handler {
+	return a.authorize(a.routes())
+}
+
+func (a *AdminAPI) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, a.Handler())
+}
+
+// ServeUnix serves the admin API without a token on a Unix socket that
+// only the owner of the process can connect to. The socket is bound in a
+// private directory and moved into place once restricted, so it is never
+// reachable with looser permissions. Only a stale socket left behind by
+// a previous run is replaced.
+func (a *AdminAPI) ServeUnix(path string) error {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".ganted-ctl-")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		os.Remove(dir)
+		return err
+	}
+	// the listener would unlink tmp, not path
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	defer l.Close()
+	err = os.Chmod(tmp, 0o600)
+	if err == nil {
+		err = checkStaleSocket(path)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	return http.Serve(l, a.routes())
+}
+
+// checkStaleSocket refuses to replace path unless it is missing or a
+// socket nobody listens on, so a mistyped path cannot clobber a file and
+// a second ganted cannot take over the socket of a running one
+func checkStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return nil
+}
+
+// authorize rejects requests without the admin bearer token, and all
+// of them if no token is set
+func (a *AdminAPI) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || a.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("admin API: failed to write response", "err", err)
+	}
+}
+
+// GET /status
+func (a *AdminAPI) status(w http.ResponseWriter, req *http.Request) {
+	sessions := a.Server.Sessions()
+	users := make(map[string]bool)
+	for _, s := range sessions {
+		users[s.Username] = true
+	}
+	cached := 0
+	a.Credentials.Cache.Map.Range(func(_, _ interface{}) bool {
+		cached++
+		return true
+	})
+	writeJSON(w, adminStatus{
+		StartTime:   a.StartTime,
+		Uptime:      time.Since(a.StartTime).Round(time.Second).String(),
+		Sessions:    len(sessions),
+		Users:       len(users),
+		CachedUsers: cached,
+	})
+}
+
+// POST /reload
+func (a *AdminAPI) reload(w http.ResponseWriter, req *http.Request) {
+	if err := a.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("admin API: configuration reloaded")
+	writeJSON(w, map[string]bool{"reloaded": true})
+}
+
+// POST /accounting
+func (a *AdminAPI) runAccounting(w http.ResponseWriter, req *http.Request) {
+	if err := a.Credentials.accounting(a.Usage, a.Server.Sessions); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]bool{"accounted": true})
+}
+
+// GET /usage reports the bytes per user in the current accounting period,
+// including the live sessions
+func (a *AdminAPI) usage(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, a.Usage.Current(a.Server.Sessions))
+}
+
+// GET /sessions[?user=<name>]
+func (a *AdminAPI) listSessions(w http.ResponseWriter, req *http.Request) {
+	user := req.URL.Query().Get("user")
+	sessions := []adminSession{}
+	for _, s := range a.Server.Sessions() {
+		if user != "" && s.Username != user {
+			continue
+		}
+		// clients of Unix sockets have no address
+		client := s.RemoteAddr.Address()
+		if s.RemoteAddr.IP == nil {
+			client = s.RemoteAddr.FQDN
+		}
+		sessions = append(sessions, adminSession{
+			ID:          s.ID,
+			User:        s.Username,
+			Client:      client,
+			Destination: s.DestAddr.String(),
+			Listener:    s.Listener,
+			StartTime:   s.StartTime,
+			BytesIn:     s.ReadBytes(),
+			BytesOut:    s.WriteBytes(),
+		})
+	}
+	writeJSON(w, sessions)
+}
+
+// DELETE /sessions/{id}
+func (a *AdminAPI) killSession(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(req.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+	if !a.Server.CloseSession(id) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("admin API: killed session", "conn_id", id)
+	writeJSON(w, map[string]int{"closed": 1})
+}
+
+// DELETE /users/{user}/sessions
+func (a *AdminAPI) killUserSessions(w http.ResponseWriter, req *http.Request) {
+	user := req.PathValue("user")
+	n := a.Server.CloseUserSessions(user)
+	slog.Info("admin API: killed sessions", "user", user, "count", n)
+	writeJSON(w, map[string]int{"closed": n})
+}
+
+// GET /auth-cache
+func (a *AdminAPI) listCache(w http.ResponseWriter, req *http.Request) {
+	entries := []adminCacheEntry{}
+	a.Credentials.Cache.Map.Range(func(key, value interface{}) bool {
+		item := value.(RadiusCacheItem)
+		entries = append(entries, adminCacheEntry{
+			User:      key.(string),
+			LastUsed:  item.LastUsed,
+			ExpiresAt: item.LastUsed.Add(a.Credentials.Cache.Retention),
+		})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].User < entries[j].User })
+	writeJSON(w, entries)
+}
+
+// DELETE /auth-cache[/{user}]
+func (a *AdminAPI) flushCache(w http.ResponseWriter, req *http.Request) {
+	n := a.Credentials.flushCache(req.PathValue("user"))
+	slog.Info("admin API: flushed auth cache entries", "count", n)
+	writeJSON(w, map[string]int{"flushed": n})
+}
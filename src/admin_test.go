@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/net/proxy"
+)
+
+// sessionServer is a SOCKS server for alice and bob, with an echo
+// server to relay to
+type sessionServer struct {
+	*socks5.Server
+	addr string
+	echo string
+}
+
+func newSessionServer(t *testing.T, conf *socks5.Config) *sessionServer {
+	conf.Credentials = socks5.StaticCredentials{"alice": "secret", "bob": "secret"}
+	conf.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	conf.AccessLogger = log.New(io.Discard, "", 0)
+	// hide the TCP target from splice, which updates the byte counts
+	// only every spliceInterval
+	conf.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return struct{ *net.TCPConn }{conn.(*net.TCPConn)}, nil
+	}
+	server, err := socks5.New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go server.Serve(l)
+	s := &sessionServer{Server: server, addr: l.Addr().String()}
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	s.echo = echo.Addr().String()
+	return s
+}
+
+// dial opens a session of user to the echo server
+func (s *sessionServer) dial(t *testing.T, user string) net.Conn {
+	dialer, err := proxy.SOCKS5("tcp", s.addr, &proxy.Auth{User: user, Password: "secret"}, proxy.Direct)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn, err := dialer.Dial("tcp", s.echo)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// transfer sends n bytes over conn and reads them back
+func transfer(t *testing.T, conn net.Conn, n int) {
+	if _, err := conn.Write(make([]byte, n)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, n)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// waitClosed waits until no session of user is left
+func (s *sessionServer) waitClosed(t *testing.T, user string) {
+	for i := 0; i < 250; i++ {
+		live := false
+		for _, sess := range s.Sessions() {
+			live = live || sess.Username == user
+		}
+		if !live {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("session of %s not closed", user)
+}
+
+// newTestAdminAPI serves the admin API of a sessionServer with token
+func newTestAdminAPI(t *testing.T, token string, reload func() error) (*sessionServer, *httptest.Server) {
+	s := newSessionServer(t, &socks5.Config{})
+	a := &AdminAPI{
+		Token:       token,
+		Server:      s.Server,
+		Credentials: &RadiusCredentials{Cache: RadiusCache{Retention: time.Minute}},
+		StartTime:   time.Now(),
+		Reload:      reload,
+	}
+	srv := httptest.NewServer(a.Handler())
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+// adminRequest sends a request with the bearer token, if set, and
+// decodes the JSON response into v, if not nil
+func adminRequest(t *testing.T, srv *httptest.Server, method, path, token string, v interface{}) int {
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.Unmarshal(body, v); err != nil {
+			t.Fatalf("bad: %s: %v", body, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminAPI_Authorize(t *testing.T) {
+	_, srv := newTestAdminAPI(t, "secret", nil)
+	for _, c := range []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"no header", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer wrong", http.StatusUnauthorized},
+		{"prefix of the token", "Bearer secre", http.StatusUnauthorized},
+		{"empty token", "Bearer ", http.StatusUnauthorized},
+		{"basic auth", "Basic c2VjcmV0", http.StatusUnauthorized},
+		{"bare token", "secret", http.StatusUnauthorized},
+		{"token", "Bearer secret", http.StatusOK},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+"/status", nil)
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Fatalf("bad: %s: %d", c.name, resp.StatusCode)
+		}
+	}
+
+	// without a token configured, nothing is authorized
+	_, open := newTestAdminAPI(t, "", nil)
+	req, _ := http.NewRequest("GET", open.URL+"/status", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("bad: %d", resp.StatusCode)
+	}
+}
+
+func TestAdminAPI_Sessions(t *testing.T) {
+	s, srv := newTestAdminAPI(t, "secret", nil)
+	alice := s.dial(t, "alice")
+	s.dial(t, "bob")
+	transfer(t, alice, 100)
+
+	var sessions []adminSession
+	if status := adminRequest(t, srv, "GET", "/sessions", "secret", &sessions); status != http.StatusOK {
+		t.Fatalf("bad: %d", status)
+	}
+	if len(sessions) != 2 || sessions[0].User != "alice" || sessions[1].User != "bob" {
+		t.Fatalf("bad: %+v", sessions)
+	}
+	if sessions[0].Destination != s.echo || !strings.HasPrefix(sessions[0].Client, "127.0.0.1:") {
+		t.Fatalf("bad: %+v", sessions[0])
+	}
+	if sessions[0].BytesIn < 100 || sessions[0].BytesOut < 100 {
+		t.Fatalf("bad: %+v", sessions[0])
+	}
+	aliceID := sessions[0].ID
+
+	sessions = nil
+	if adminRequest(t, srv, "GET", "/sessions?user=bob", "secret", &sessions); len(sessions) != 1 || sessions[0].User != "bob" {
+		t.Fatalf("bad: %+v", sessions)
+	}
+	sessions = nil
+	if adminRequest(t, srv, "GET", "/sessions?user=carol", "secret", &sessions); sessions == nil || len(sessions) != 0 {
+		t.Fatalf("bad: %+v", sessions)
+	}
+
+	// kill a session by ID
+	var closed map[string]int
+	if status := adminRequest(t, srv, "DELETE", "/sessions/"+strconv.FormatUint(aliceID, 10), "secret", &closed); status != http.StatusOK || closed["closed"] != 1 {
+		t.Fatalf("bad: %d %v", status, closed)
+	}
+	s.waitClosed(t, "alice")
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := alice.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("client still connected")
+	}
+	if status := adminRequest(t, srv, "DELETE", "/sessions/"+strconv.FormatUint(aliceID, 10), "secret", nil); status != http.StatusNotFound {
+		t.Fatalf("bad: %d", status)
+	}
+	if status := adminRequest(t, srv, "DELETE", "/sessions/alice", "secret", nil); status != http.StatusBadRequest {
+		t.Fatalf("bad: %d", status)
+	}
+
+	// kill the sessions of a user
+	closed = nil
+	if status := adminRequest(t, srv, "DELETE", "/users/bob/sessions", "secret", &closed); status != http.StatusOK || closed["closed"] != 1 {
+		t.Fatalf("bad: %d %v", status, closed)
+	}
+	s.waitClosed(t, "bob")
+	if status := adminRequest(t, srv, "DELETE", "/users/bob/sessions", "secret", &closed); status != http.StatusOK || closed["closed"] != 0 {
+		t.Fatalf("bad: %d %v", status, closed)
+	}
+
+	// the token is checked before the route
+	if status := adminRequest(t, srv, "DELETE", "/users/bob/sessions", "", nil); status != http.StatusUnauthorized {
+		t.Fatalf("bad: %d", status)
+	}
+}
+
+func TestAdminAPI_Reload(t *testing.T) {
+	var reloads int32
+	var fail atomic.Bool
+	_, srv := newTestAdminAPI(t, "secret", func() error {
+		atomic.AddInt32(&reloads, 1)
+		if fail.Load() {
+			return errors.New("GANTED_ACL: invalid network")
+		}
+		return nil
+	})
+	var reloaded map[string]bool
+	if status := adminRequest(t, srv, "POST", "/reload", "secret", &reloaded); status != http.StatusOK || !reloaded["reloaded"] {
+		t.Fatalf("bad: %d %v", status, reloaded)
+	}
+	// only POST reloads, with the token
+	if status := adminRequest(t, srv, "GET", "/reload", "secret", nil); status != http.StatusMethodNotAllowed {
+		t.Fatalf("bad: %d", status)
+	}
+	if status := adminRequest(t, srv, "POST", "/reload", "", nil); status != http.StatusUnauthorized {
+		t.Fatalf("bad: %d", status)
+	}
+	if n := atomic.LoadInt32(&reloads); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	fail.Store(true)
+	req, _ := http.NewRequest("POST", srv.URL+"/reload", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusInternalServerError || !strings.Contains(string(body), "invalid network") {
+		t.Fatalf("bad: %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestAdminAPI_ServeUnix(t *testing.T) {
+	a := &AdminAPI{
+		Server:      newSessionServer(t, &socks5.Config{}).Server,
+		Credentials: &RadiusCredentials{Cache: RadiusCache{Retention: time.Minute}},
+		StartTime:   time.Now(),
+	}
+	dir := t.TempDir()
+
+	// a file in the way is left alone
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := a.ServeUnix(path); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Fatalf("bad: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "data" {
+		t.Fatalf("bad: %q %v", data, err)
+	}
+
+	// so is the socket of a running server
+	path = filepath.Join(dir, "live.sock")
+	live, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer live.Close()
+	if err := a.ServeUnix(path); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// a stale socket is replaced
+	path = filepath.Join(dir, "stale.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	go a.ServeUnix(path)
+	c := newCtlClient(path)
+	var status adminStatus
+	for i := 0; ; i++ {
+		if err = c.call("GET", "/status", &status); err == nil {
+			break
+		}
+		if i == 250 {
+			t.Fatalf("err: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("bad: %v %v", fi, err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// defaultControlSocket is where gantedctl looks for the control socket,
+// which ganted opens only when GANTED_CONTROL_SOCKET is set
+const defaultControlSocket = "/run/ganted.sock"
+
+const ctlUsage = `Usage: gantedctl [-socket path] <command> [args]
+
+Commands:
+  status               show server status
+  sessions [user]      list live sessions, optionally of one user
+  kill <id>            terminate a session
+  kill-user <user>     terminate all sessions of a user
+  reload               reload configuration from GANTED_ENV_FILE
+  flush-cache [user]   flush the auth cache, or one user's entry
+  accounting           run accounting now
+  usage                show per-user usage in the current accounting period
+
+ganted does not enforce quotas itself; usage shows the traffic reported
+to RADIUS accounting, where any quota has to be applied.
+`
+
+// ctlClient talks to the admin API on the control socket of a running ganted
+type ctlClient struct {
+	http.Client
+}
+
+func newCtlClient(socket string) *ctlClient {
+	return &ctlClient{http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}}
+}
+
+// call sends a request to the admin API and decodes the JSON reply into v
+func (c *ctlClient) call(method, path string, v interface{}) error {
+	req, err := http.NewRequest(method, "http://ganted"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// ctl runs a gantedctl command and returns the exit status
+func ctl(args []string) int {
+	flags := flag.NewFlagSet("gantedctl", flag.ContinueOnError)
+	socket := flags.String("socket", getEnv("GANTED_CONTROL_SOCKET", defaultControlSocket), "path of the control socket")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), ctlUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	c := newCtlClient(*socket)
+	cmd, cmdArgs := flags.Arg(0), flags.Args()[1:]
+	arg := func(i int) string {
+		if i < len(cmdArgs) {
+			return cmdArgs[i]
+		}
+		return ""
+	}
+
+	var err error
+	switch {
+	case cmd == "status" && len(cmdArgs) == 0:
+		err = c.status()
+	case cmd == "sessions" && len(cmdArgs) <= 1:
+		err = c.sessions(arg(0))
+	case cmd == "kill" && len(cmdArgs) == 1:
+		err = c.printResult("DELETE", "/sessions/"+url.PathEscape(arg(0)))
+	case cmd == "kill-user" && len(cmdArgs) == 1:
+		err = c.printResult("DELETE", "/users/"+url.PathEscape(arg(0))+"/sessions")
+	case cmd == "reload" && len(cmdArgs) == 0:
+		err = c.printResult("POST", "/reload")
+	case cmd == "flush-cache" && len(cmdArgs) <= 1:
+		path := "/auth-cache"
+		if arg(0) != "" {
+			path += "/" + url.PathEscape(arg(0))
+		}
+		err = c.printResult("DELETE", path)
+	case cmd == "accounting" && len(cmdArgs) == 0:
+		err = c.printResult("POST", "/accounting")
+	case cmd == "usage" && len(cmdArgs) == 0:
+		err = c.usage()
+	default:
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gantedctl: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// printResult prints the counters returned by simple actions
+func (c *ctlClient) printResult(method, path string) error {
+	var result map[string]interface{}
+	if err := c.call(method, path, &result); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(result))
+	for k := range result {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%s: %v\n", k, result[k])
+	}
+	return nil
+}
+
+func (c *ctlClient) status() error {
+	var status adminStatus
+	if err := c.call("GET", "/status", &status); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Started:\t%s\n", status.StartTime.Format(time.RFC3339))
+	fmt.Fprintf(tw, "Uptime:\t%s\n", status.Uptime)
+	fmt.Fprintf(tw, "Sessions:\t%d\n", status.Sessions)
+	fmt.Fprintf(tw, "Users:\t%d\n", status.Users)
+	fmt.Fprintf(tw, "Cached users:\t%d\n", status.CachedUsers)
+	return tw.Flush()
+}
+
+func (c *ctlClient) sessions(user string) error {
+	path := "/sessions"
+	if user != "" {
+		path += "?user=" + url.QueryEscape(user)
+	}
+	var sessions []adminSession
+	if err := c.call("GET", path, &sessions); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSER\tCLIENT\tDESTINATION\tSTARTED\tIN\tOUT")
+	for _, s := range sessions {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%d\n",
+			s.ID, s.User, s.Client, s.Destination,
+			s.StartTime.Format(time.RFC3339), s.BytesIn, s.BytesOut)
+	}
+	return tw.Flush()
+}
+
+func (c *ctlClient) usage() error {
+	var usage map[string]int64
+	if err := c.call("GET", "/usage", &usage); err != nil {
+		return err
+	}
+	users := make([]string, 0, len(usage))
+	for user := range usage {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tBYTES")
+	for _, user := range users {
+		fmt.Fprintf(tw, "%s\t%d\n", user, usage[user])
+	}
+	return tw.Flush()
+}
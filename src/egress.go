@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/armon/go-socks5"
+)
+
+// EgressPool dials outbound connections from one of several source
+// addresses. Only addresses of the destination's family are considered;
+// among them, a user pinned in Users always gets its address, and the
+// others are spread according to Policy.
+type EgressPool struct {
+	Addrs []net.IP
+	// Policy is "round-robin", "user-hash" (stable address per user) or
+	// "family" (first address of the destination's family)
+	Policy string
+	Users  map[string]net.IP
+	// Mark sets SO_MARK on outbound sockets for policy routing, if non-zero
+	Mark int
+	// Interface binds outbound sockets to a network interface, if set
+	Interface string
+
+	next uint64
+}
+
+// newEgressPoolFromEnv reads GANTED_BIND_OUTPUT (comma-separated
+// addresses), GANTED_EGRESS_POLICY, GANTED_EGRESS_USERS (user=address
+// pairs), GANTED_SO_MARK and GANTED_BIND_INTERFACE
+func newEgressPoolFromEnv() (*EgressPool, error) {
+	p := &EgressPool{
+		Policy:    getEnv("GANTED_EGRESS_POLICY", "round-robin"),
+		Users:     make(map[string]net.IP),
+		Interface: getEnv("GANTED_BIND_INTERFACE", ""),
+	}
+	switch p.Policy {
+	case "round-robin", "user-hash", "family":
+	default:
+		return nil, fmt.Errorf("unknown egress policy %q, expected round-robin, user-hash or family", p.Policy)
+	}
+	for _, s := range strings.Split(getEnv("GANTED_BIND_OUTPUT", ""), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid egress address %q", s)
+		}
+		p.Addrs = append(p.Addrs, ip)
+	}
+	pairs, err := splitPairs(getEnv("GANTED_EGRESS_USERS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("egress users: %w", err)
+	}
+	for _, pair := range pairs {
+		ip := net.ParseIP(pair[1])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid egress address %q for %s", pair[1], pair[0])
+		}
+		p.Users[pair[0]] = ip
+	}
+	if p.Mark, err = strconv.Atoi(getEnv("GANTED_SO_MARK", "0")); err != nil {
+		return nil, fmt.Errorf("invalid GANTED_SO_MARK: %w", err)
+	}
+	if (p.Mark != 0 || p.Interface != "") && !socketOptionsSupported {
+		return nil, fmt.Errorf("GANTED_SO_MARK and GANTED_BIND_INTERFACE are only supported on Linux")
+	}
+	return p, nil
+}
+
+// pick chooses the source address for a connection of user to addr, or
+// nil to let the system choose
+func (p *EgressPool) pick(user, addr string) net.IP {
+	var dest net.IP
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		dest = net.ParseIP(host)
+	}
+	if ip, ok := p.Users[user]; ok && user != "" && (dest == nil || socks5.SameFamily(ip, dest)) {
+		return ip
+	}
+
+	candidates := p.Addrs
+	if dest != nil {
+		candidates = nil
+		for _, ip := range p.Addrs {
+			if socks5.SameFamily(ip, dest) {
+				candidates = append(candidates, ip)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	switch p.Policy {
+	case "user-hash":
+		h := fnv.New32a()
+		h.Write([]byte(user))
+		return candidates[h.Sum32()%uint32(len(candidates))]
+	case "family":
+		return candidates[0]
+	default:
+		n := atomic.AddUint64(&p.next, 1)
+		return candidates[n%uint64(len(candidates))]
+	}
+}
+
+// DialContext implements socks5.Config.Dial.
+func (p *EgressPool) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{}
+	var user string
+	if auth, ok := socks5.AuthInfo(ctx); ok {
+		user = auth.Payload["Username"]
+	}
+	if ip := p.pick(user, addr); ip != nil {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+		socks5.Logger(ctx).Debug("dialing from egress address", "egress", ip.String(), "addr", addr)
+	}
+	if p.Mark != 0 || p.Interface != "" {
+		d.Control = p.setSocketOptions
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// Dial lets the pool forward connections of golang.org/x/net/proxy dialers
+func (p *EgressPool) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
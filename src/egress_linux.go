@@ -0,0 +1,26 @@
+package main
+
+import (
+	"syscall"
+)
+
+const socketOptionsSupported = true
+
+// setSocketOptions applies SO_MARK and SO_BINDTODEVICE before connecting
+func (p *EgressPool) setSocketOptions(network, address string, c syscall.RawConn) error {
+	var err error
+	ctrlErr := c.Control(func(fd uintptr) {
+		if p.Mark != 0 {
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, p.Mark); err != nil {
+				return
+			}
+		}
+		if p.Interface != "" {
+			err = syscall.BindToDevice(int(fd), p.Interface)
+		}
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
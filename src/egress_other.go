@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"syscall"
+)
+
+const socketOptionsSupported = false
+
+func (p *EgressPool) setSocketOptions(network, address string, c syscall.RawConn) error {
+	return nil
+}
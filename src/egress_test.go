@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestEgressPool_Pick(t *testing.T) {
+	v4a, v4b, v4c := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")
+	v6a, v6b := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	type step struct {
+		user string
+		addr string
+		want net.IP
+	}
+	for _, c := range []struct {
+		name  string
+		pool  *EgressPool
+		steps []step
+	}{
+		{
+			name: "round-robin",
+			pool: &EgressPool{Addrs: []net.IP{v4a, v6a, v4b}, Policy: "round-robin"},
+			steps: []step{
+				{"alice", "198.51.100.1:443", v4b},
+				{"alice", "198.51.100.1:443", v4a},
+				{"bob", "198.51.100.1:443", v4b},
+				{"bob", "[2001:db8:1::1]:443", v6a},
+			},
+		},
+		{
+			name: "round-robin without the family",
+			pool: &EgressPool{Addrs: []net.IP{v4a, v4b}, Policy: "round-robin"},
+			steps: []step{
+				{"alice", "[2001:db8:1::1]:443", nil},
+			},
+		},
+		{
+			name: "round-robin to a name",
+			pool: &EgressPool{Addrs: []net.IP{v4a, v6a}, Policy: "round-robin"},
+			steps: []step{
+				{"alice", "example.com:443", v6a},
+				{"alice", "example.com:443", v4a},
+			},
+		},
+		{
+			name: "family",
+			pool: &EgressPool{Addrs: []net.IP{v6b, v4b, v6a, v4a}, Policy: "family"},
+			steps: []step{
+				{"alice", "198.51.100.1:443", v4b},
+				{"bob", "198.51.100.1:443", v4b},
+				{"alice", "[2001:db8:1::1]:443", v6b},
+			},
+		},
+		{
+			name: "no addresses",
+			pool: &EgressPool{Policy: "round-robin"},
+			steps: []step{
+				{"alice", "198.51.100.1:443", nil},
+			},
+		},
+		{
+			name: "pinned users",
+			pool: &EgressPool{
+				Addrs:  []net.IP{v4a, v6a},
+				Policy: "family",
+				Users:  map[string]net.IP{"carol": v4c, "dave": v6b},
+			},
+			steps: []step{
+				{"carol", "198.51.100.1:443", v4c},
+				{"carol", "example.com:443", v4c},
+				// a pinned address of the other family is not used
+				{"carol", "[2001:db8:1::1]:443", v6a},
+				{"dave", "[2001:db8:1::1]:443", v6b},
+				{"dave", "198.51.100.1:443", v4a},
+				{"", "198.51.100.1:443", v4a},
+			},
+		},
+	} {
+		for i, s := range c.steps {
+			if ip := c.pool.pick(s.user, s.addr); !ip.Equal(s.want) {
+				t.Fatalf("bad: %s: step %d: %v, expected %v", c.name, i, ip, s.want)
+			}
+		}
+	}
+}
+
+func TestEgressPool_PickUserHash(t *testing.T) {
+	addrs := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::1")}
+	p := &EgressPool{Addrs: addrs, Policy: "user-hash"}
+	used := make(map[string]bool)
+	for _, user := range []string{"alice", "bob", "carol", "dave", "eve", "frank", "grace", "heidi"} {
+		ip := p.pick(user, "198.51.100.1:443")
+		if ip.To4() == nil {
+			t.Fatalf("bad: %s: %v", user, ip)
+		}
+		// the address of a user is stable
+		for i := 0; i < 3; i++ {
+			if again := p.pick(user, "198.51.100.1:443"); !again.Equal(ip) {
+				t.Fatalf("bad: %s: %v then %v", user, ip, again)
+			}
+		}
+		used[ip.String()] = true
+	}
+	if len(used) != 2 {
+		t.Fatalf("users not spread: %v", used)
+	}
+}
+
+func TestNewEgressPoolFromEnv(t *testing.T) {
+	t.Setenv("GANTED_BIND_OUTPUT", "192.0.2.1, 2001:db8::1")
+	t.Setenv("GANTED_EGRESS_POLICY", "user-hash")
+	t.Setenv("GANTED_EGRESS_USERS", "alice=192.0.2.9")
+	p, err := newEgressPoolFromEnv()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(p.Addrs) != 2 || !p.Addrs[1].Equal(net.ParseIP("2001:db8::1")) || p.Policy != "user-hash" {
+		t.Fatalf("bad: %+v", p)
+	}
+	if !p.Users["alice"].Equal(net.ParseIP("192.0.2.9")) {
+		t.Fatalf("bad: %v", p.Users)
+	}
+
+	for key, value := range map[string]string{
+		"GANTED_BIND_OUTPUT":   "192.0.2.300",
+		"GANTED_EGRESS_POLICY": "random",
+		"GANTED_EGRESS_USERS":  "alice=nowhere",
+		"GANTED_SO_MARK":       "0x10",
+	} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, value)
+			if _, err := newEgressPoolFromEnv(); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
+
+func TestEgressPool_DialContext(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs 127.0.0.0/8 on the loopback interface")
+	}
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	p := &EgressPool{Addrs: []net.IP{net.ParseIP("127.0.0.2")}, Policy: "round-robin"}
+	conn, err := p.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer accepted.Close()
+	if ip := accepted.RemoteAddr().(*net.TCPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("bad: %v", ip)
+	}
+}
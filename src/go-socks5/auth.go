@@ -3,6 +3,8 @@ package socks5
 import (
 	"fmt"
 	"io"
+
+	"golang.org/x/net/context"
 )
 
 const (
@@ -37,11 +39,20 @@ type AuthContext struct {
 	Payload map[string]string
 }
 
+// Authenticator implements an authentication method. ctx is the context
+// of the connection, cancelled when the connection is closed.
 type Authenticator interface {
-	Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error)
+	Authenticate(ctx context.Context, reader io.Reader, writer io.Writer) (*AuthContext, error)
 	GetCode() uint8
 }
 
+// ConditionalAuthenticator can be implemented by an Authenticator that
+// only applies to some connections, e.g. TLS ones. For the others it is
+// skipped as if the server did not support its method.
+type ConditionalAuthenticator interface {
+	Applicable(ctx context.Context) bool
+}
+
 // NoAuthAuthenticator is used to handle the "No Authentication" mode
 type NoAuthAuthenticator struct{}
 
@@ -49,7 +60,7 @@ func (a NoAuthAuthenticator) GetCode() uint8 {
 	return NoAuth
 }
 
-func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+func (a NoAuthAuthenticator) Authenticate(ctx context.Context, reader io.Reader, writer io.Writer) (*AuthContext, error) {
 	_, err := writer.Write([]byte{socks5Version, NoAuth})
 	return &AuthContext{NoAuth, nil}, err
 }
@@ -64,7 +75,7 @@ func (a UserPassAuthenticator) GetCode() uint8 {
 	return UserPassAuth
 }
 
-func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+func (a UserPassAuthenticator) Authenticate(ctx context.Context, reader io.Reader, writer io.Writer) (*AuthContext, error) {
 	// Tell the client to use user/pass auth
 	if _, err := writer.Write([]byte{socks5Version, UserPassAuth}); err != nil {
 		return nil, err
@@ -72,7 +83,7 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 
 	// Get the version and username length
 	header := []byte{0, 0}
-	if _, err := io.ReadAtLeast(reader, header, 2); err != nil {
+	if _, err := io.ReadFull(reader, header); err != nil {
 		return nil, err
 	}
 
@@ -84,24 +95,24 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 	// Get the user name
 	userLen := int(header[1])
 	user := make([]byte, userLen)
-	if _, err := io.ReadAtLeast(reader, user, userLen); err != nil {
+	if _, err := io.ReadFull(reader, user); err != nil {
 		return nil, err
 	}
 
 	// Get the password length
-	if _, err := reader.Read(header[:1]); err != nil {
+	if _, err := io.ReadFull(reader, header[:1]); err != nil {
 		return nil, err
 	}
 
 	// Get the password
 	passLen := int(header[0])
 	pass := make([]byte, passLen)
-	if _, err := io.ReadAtLeast(reader, pass, passLen); err != nil {
+	if _, err := io.ReadFull(reader, pass); err != nil {
 		return nil, err
 	}
 
 	// Verify the password
-	if a.Credentials.Valid(string(user), string(pass)) {
+	if a.Credentials.Valid(ctx, string(user), string(pass)) {
 		if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
 			return nil, err
 		}
@@ -117,7 +128,7 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 }
 
 // authenticate is used to handle connection authentication
-func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext, error) {
+func (s *Server) authenticate(ctx context.Context, conn io.Writer, bufConn io.Reader) (*AuthContext, error) {
 	// Get the methods
 	methods, err := readMethods(bufConn)
 	if err != nil {
@@ -125,10 +136,14 @@ func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext,
 	}
 
 	// Select a usable method
+	authMethods := s.authenticators(ctx)
 	for _, method := range methods {
-		cator, found := s.authMethods[method]
+		cator, found := authMethods[method]
+		if c, ok := cator.(ConditionalAuthenticator); ok && !c.Applicable(ctx) {
+			continue
+		}
 		if found {
-			return cator.Authenticate(bufConn, conn)
+			return cator.Authenticate(ctx, bufConn, conn)
 		}
 	}
 
@@ -147,12 +162,12 @@ func noAcceptableAuth(conn io.Writer) error {
 // and proceeding auth methods
 func readMethods(r io.Reader) ([]byte, error) {
 	header := []byte{0}
-	if _, err := r.Read(header); err != nil {
+	if _, err := io.ReadFull(r, header); err != nil {
 		return nil, err
 	}
 
 	numMethods := int(header[0])
 	methods := make([]byte, numMethods)
-	_, err := io.ReadAtLeast(r, methods, numMethods)
+	_, err := io.ReadFull(r, methods)
 	return methods, err
 }
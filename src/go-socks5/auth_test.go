@@ -3,6 +3,8 @@ package socks5
 import (
 	"bytes"
 	"testing"
+
+	"golang.org/x/net/context"
 )
 
 func TestNoAuth(t *testing.T) {
@@ -11,7 +13,7 @@ func TestNoAuth(t *testing.T) {
 	var resp bytes.Buffer
 
 	s, _ := New(&Config{})
-	ctx, err := s.authenticate(&resp, req)
+	ctx, err := s.authenticate(context.Background(), &resp, req)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -40,7 +42,7 @@ func TestPasswordAuth_Valid(t *testing.T) {
 
 	s, _ := New(&Config{AuthMethods: []Authenticator{cator}})
 
-	ctx, err := s.authenticate(&resp, req)
+	ctx, err := s.authenticate(context.Background(), &resp, req)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -76,7 +78,7 @@ func TestPasswordAuth_Invalid(t *testing.T) {
 	cator := UserPassAuthenticator{Credentials: cred}
 	s, _ := New(&Config{AuthMethods: []Authenticator{cator}})
 
-	ctx, err := s.authenticate(&resp, req)
+	ctx, err := s.authenticate(context.Background(), &resp, req)
 	if _, ok := err.(UserAuthFailed); !ok {
 		t.Fatalf("err: %v", err)
 	}
@@ -103,7 +105,7 @@ func TestNoSupportedAuth(t *testing.T) {
 
 	s, _ := New(&Config{AuthMethods: []Authenticator{cator}})
 
-	ctx, err := s.authenticate(&resp, req)
+	ctx, err := s.authenticate(context.Background(), &resp, req)
 	if err != NoSupportedAuth {
 		t.Fatalf("err: %v", err)
 	}
@@ -117,3 +119,45 @@ func TestNoSupportedAuth(t *testing.T) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+func FuzzReadMethods(f *testing.F) {
+	f.Add([]byte{1, NoAuth})
+	f.Add([]byte{2, NoAuth, UserPassAuth})
+	f.Add([]byte{0})
+	f.Add([]byte{3, NoAuth})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		methods, err := readMethods(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if len(data) == 0 || len(methods) != int(data[0]) {
+			t.Fatalf("bad: %v %v", data, methods)
+		}
+	})
+}
+
+func FuzzPasswordAuth(f *testing.F) {
+	f.Add([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	f.Add([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'z'})
+	f.Add([]byte{1, 3, 'f', 'o', 'o'})
+	f.Add([]byte{1, 0, 0})
+	f.Add([]byte{2, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	f.Add([]byte{1, 255, 'f'})
+
+	cator := UserPassAuthenticator{Credentials: StaticCredentials{"foo": "bar"}}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var resp bytes.Buffer
+		ctx, err := cator.Authenticate(context.Background(), bytes.NewReader(data), &resp)
+		if err != nil {
+			if ctx != nil {
+				t.Fatalf("context on error: %v", ctx)
+			}
+			return
+		}
+		if ctx.Method != UserPassAuth || ctx.Payload["Username"] != "foo" {
+			t.Fatalf("bad: %v", ctx)
+		}
+	})
+}
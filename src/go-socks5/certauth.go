@@ -0,0 +1,242 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/context"
+)
+
+// Client certificate identities of ClientCertAuthenticator
+const (
+	IdentityCommonName = "cn"
+	IdentityEmail      = "email"
+	IdentityDNS        = "dns"
+	IdentityURI        = "uri"
+)
+
+// ClientCertAuthenticator authenticates clients of ServeTLS by their
+// verified certificate, for clients that offer the "No Authentication"
+// method. Verification against the CA bundle is done by the TLS
+// handshake (tls.Config.ClientCAs); the certificate is then checked
+// against local revocation data and its identity becomes the Username
+// of the AuthContext, so accounting and per-user rules apply as for
+// passwords. Connections without a verified certificate skip this
+// method.
+type ClientCertAuthenticator struct {
+	// Identity selects the Username: the subject common name (the
+	// default), or the first e-mail, DNS or URI subject alternative name
+	Identity string
+	// CRLFiles are certificate revocation lists, PEM or DER. They are
+	// loaded again when they change.
+	CRLFiles []string
+	// OCSPDir holds OCSP responses for client certificates, named after
+	// the serial number in lowercase hex with a ".der" extension, e.g.
+	// as fetched by "openssl ocsp -respout". A response is only used
+	// while it is current.
+	OCSPDir string
+	// OCSPRequired rejects certificates whose response is missing, stale
+	// or unknown instead of logging a warning and accepting them.
+	OCSPRequired bool
+
+	mu   sync.Mutex
+	crls map[string]*crlFile
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// crlFile is a loaded CRL and the modification time of its file
+type crlFile struct {
+	list    *x509.RevocationList
+	modTime time.Time
+}
+
+func (a *ClientCertAuthenticator) GetCode() uint8 {
+	return NoAuth
+}
+
+// Applicable implements the ConditionalAuthenticator interface.
+func (a *ClientCertAuthenticator) Applicable(ctx context.Context) bool {
+	state, ok := TLSConnectionState(ctx)
+	return ok && len(state.VerifiedChains) > 0
+}
+
+func (a *ClientCertAuthenticator) Authenticate(ctx context.Context, reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	state, ok := TLSConnectionState(ctx)
+	if !ok || len(state.VerifiedChains) == 0 {
+		return nil, noAcceptableAuth(writer)
+	}
+	chain := state.VerifiedChains[0]
+	cert := chain[0]
+	if err := a.checkRevocation(ctx, chain); err != nil {
+		writer.Write([]byte{socks5Version, noAcceptable})
+		return nil, err
+	}
+	identity, err := a.identity(cert)
+	if err != nil {
+		writer.Write([]byte{socks5Version, noAcceptable})
+		return nil, err
+	}
+	if _, err := writer.Write([]byte{socks5Version, NoAuth}); err != nil {
+		return nil, err
+	}
+	return &AuthContext{NoAuth, map[string]string{
+		"Username":        identity,
+		ClientCertPayload: cert.Subject.String(),
+	}}, nil
+}
+
+// identity returns the Username for cert
+func (a *ClientCertAuthenticator) identity(cert *x509.Certificate) (string, error) {
+	var identity string
+	switch a.Identity {
+	case "", IdentityCommonName:
+		identity = cert.Subject.CommonName
+	case IdentityEmail:
+		if len(cert.EmailAddresses) > 0 {
+			identity = cert.EmailAddresses[0]
+		}
+	case IdentityDNS:
+		if len(cert.DNSNames) > 0 {
+			identity = cert.DNSNames[0]
+		}
+	case IdentityURI:
+		if len(cert.URIs) > 0 {
+			identity = cert.URIs[0].String()
+		}
+	default:
+		return "", fmt.Errorf("Unknown client certificate identity %q", a.Identity)
+	}
+	if identity == "" {
+		return "", fmt.Errorf("Client certificate %q has no %s identity", cert.Subject, a.Identity)
+	}
+	return identity, nil
+}
+
+// checkRevocation checks every certificate of a verified chain but the
+// root against the CRLs, and the client certificate against its OCSP
+// response
+func (a *ClientCertAuthenticator) checkRevocation(ctx context.Context, chain []*x509.Certificate) error {
+	crls, err := a.loadCRLs()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if a.now != nil {
+		now = a.now()
+	}
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		for _, crl := range crls {
+			if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) || crl.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+			for _, revoked := range crl.RevokedCertificateEntries {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("Certificate %q is revoked", cert.Subject)
+				}
+			}
+		}
+	}
+	if a.OCSPDir != "" && len(chain) > 1 {
+		return a.checkOCSP(ctx, chain[0], chain[1], now)
+	}
+	return nil
+}
+
+// loadCRLs returns the CRLs, loading the files that changed
+func (a *ClientCertAuthenticator) loadCRLs() ([]*x509.RevocationList, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.crls == nil {
+		a.crls = make(map[string]*crlFile)
+	}
+	var lists []*x509.RevocationList
+	for _, path := range a.CRLFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if f, ok := a.crls[path]; ok && f.modTime.Equal(info.ModTime()) {
+			lists = append(lists, f.list)
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		list, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		a.crls[path] = &crlFile{list: list, modTime: info.ModTime()}
+		lists = append(lists, list)
+	}
+	return lists, nil
+}
+
+// checkOCSP checks cert against its response in OCSPDir. A missing,
+// stale or unknown response is logged and, unless OCSPRequired is set,
+// the certificate accepted.
+func (a *ClientCertAuthenticator) checkOCSP(ctx context.Context, cert, issuer *x509.Certificate, now time.Time) error {
+	logger := Logger(ctx).With("subject", cert.Subject.String(), "serial", fmt.Sprintf("%x", cert.SerialNumber))
+	der, err := os.ReadFile(filepath.Join(a.OCSPDir, fmt.Sprintf("%x.der", cert.SerialNumber)))
+	if os.IsNotExist(err) {
+		if a.OCSPRequired {
+			return fmt.Errorf("No OCSP response for %q", cert.Subject)
+		}
+		logger.Warn("no OCSP response for client certificate")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp, err := ocsp.ParseResponseForCert(der, cert, issuer)
+	if err != nil {
+		return fmt.Errorf("OCSP response for %q: %w", cert.Subject, err)
+	}
+	// A delegated responder must be trusted for OCSP by the issuer
+	// (RFC 6960, section 4.2.2.2)
+	if resp.Certificate != nil && !resp.Certificate.Equal(issuer) && !ocspSigner(resp.Certificate) {
+		return fmt.Errorf("OCSP response for %q: responder %q is not authorized", cert.Subject, resp.Certificate.Subject)
+	}
+	if now.Before(resp.ThisUpdate) || (!resp.NextUpdate.IsZero() && now.After(resp.NextUpdate)) {
+		// stale, as good as no response
+		if a.OCSPRequired {
+			return fmt.Errorf("Stale OCSP response for %q", cert.Subject)
+		}
+		logger.Warn("stale OCSP response for client certificate", "this_update", resp.ThisUpdate, "next_update", resp.NextUpdate)
+		return nil
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("Certificate %q is revoked", cert.Subject)
+	}
+	if a.OCSPRequired {
+		return fmt.Errorf("OCSP status of %q is unknown", cert.Subject)
+	}
+	logger.Warn("OCSP status of client certificate is unknown")
+	return nil
+}
+
+// ocspSigner tells if cert may sign OCSP responses for its issuer
+func ocspSigner(cert *x509.Certificate) bool {
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageOCSPSigning {
+			return true
+		}
+	}
+	return false
+}
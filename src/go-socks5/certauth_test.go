@@ -0,0 +1,255 @@
+package socks5
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/context"
+)
+
+// certAuthRequest connects over TLS offering methods and returns the
+// method the server selected
+func certAuthRequest(t *testing.T, addr string, ca *testCA, cert *tls.Certificate, methods ...byte) byte {
+	config := &tls.Config{RootCAs: ca.pool, ServerName: "proxy.example"}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write(append([]byte{5, byte(len(methods))}, methods...))
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	switch reply[1] {
+	case NoAuth:
+		conn.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	case UserPassAuth:
+		conn.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r', 5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	default:
+		return reply[1]
+	}
+	// wait for the rules to reject the request
+	io.ReadAll(conn)
+	return reply[1]
+}
+
+func TestClientCertAuthenticator(t *testing.T) {
+	ca := newTestCA(t)
+	alice := ca.issue(t, "alice", 3, "")
+	bob := ca.issue(t, "bob", 4, "")
+	crlFile := filepath.Join(t.TempDir(), "ca.crl")
+
+	rules := &recordingRules{}
+	addr := startTLSServer(t, &Config{
+		AuthMethods: []Authenticator{
+			&ClientCertAuthenticator{CRLFiles: []string{crlFile}},
+			&UserPassAuthenticator{StaticCredentials{"foo": "bar"}},
+		},
+		Rules:  rules,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "proxy", 2, "proxy.example")},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.pool,
+	})
+	user := func() string { return rules.last().user }
+
+	// bob is revoked
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-time.Hour),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: big.NewInt(4), RevocationTime: time.Now()}},
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.WriteFile(crlFile, der, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if method := certAuthRequest(t, addr, ca, &alice, NoAuth); method != NoAuth || user() != "alice" {
+		t.Fatalf("bad: %v %q", method, user())
+	}
+	if method := certAuthRequest(t, addr, ca, &bob, NoAuth); method != noAcceptable {
+		t.Fatalf("bad: %v", method)
+	}
+	// without a certificate the client falls back to a password
+	if method := certAuthRequest(t, addr, ca, nil, NoAuth, UserPassAuth); method != UserPassAuth || user() != "foo" {
+		t.Fatalf("bad: %v %q", method, user())
+	}
+	if method := certAuthRequest(t, addr, ca, nil, NoAuth); method != noAcceptable {
+		t.Fatalf("bad: %v", method)
+	}
+}
+
+func TestClientCertAuthenticator_Identity(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.org/alice")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "Alice"},
+		EmailAddresses: []string{"alice@example.org"},
+		URIs:           []*url.URL{uri},
+	}
+	for identity, expected := range map[string]string{
+		"":                 "Alice",
+		IdentityCommonName: "Alice",
+		IdentityEmail:      "alice@example.org",
+		IdentityURI:        "spiffe://example.org/alice",
+	} {
+		a := &ClientCertAuthenticator{Identity: identity}
+		if id, err := a.identity(cert); err != nil || id != expected {
+			t.Fatalf("bad: %s: %q %v", identity, id, err)
+		}
+	}
+	a := &ClientCertAuthenticator{Identity: IdentityDNS}
+	if _, err := a.identity(cert); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+// ocspTestResponse builds an OCSP response for cert signed by signer,
+// with responder embedded if set
+func ocspTestResponse(t *testing.T, ca *testCA, signer crypto.Signer, responder, cert *x509.Certificate, status int, thisUpdate, nextUpdate time.Time) []byte {
+	der, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+		Status:       status,
+		SerialNumber: cert.SerialNumber,
+		ThisUpdate:   thisUpdate,
+		NextUpdate:   nextUpdate,
+		RevokedAt:    thisUpdate,
+		Certificate:  responder,
+	}, signer)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return der
+}
+
+// ocspResponder returns a delegated OCSP responder certificate of ca,
+// trusted for OCSP signing if signing is set
+func ocspResponder(t *testing.T, ca *testCA, signing bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(100),
+		Subject:      pkix.Name{CommonName: "responder"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if signing {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return cert, key
+}
+
+func TestClientCertAuthenticator_OCSP(t *testing.T) {
+	ca := newTestCA(t)
+	other := newTestCA(t)
+	alice := ca.issue(t, "alice", 3, "")
+	chain := []*x509.Certificate{alice.Leaf, ca.cert}
+	delegated, delegatedKey := ocspResponder(t, ca, true)
+	notDelegated, notDelegatedKey := ocspResponder(t, ca, false)
+	dir := t.TempDir()
+	now := time.Now()
+	ctx := withLogger(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	a := &ClientCertAuthenticator{OCSPDir: dir}
+	a.now = func() time.Time { return now }
+	strict := &ClientCertAuthenticator{OCSPDir: dir, OCSPRequired: true}
+	strict.now = a.now
+
+	// no response, good unless required
+	if err := a.checkRevocation(ctx, chain); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := strict.checkRevocation(ctx, chain); err == nil {
+		t.Fatalf("accepted without a response")
+	}
+	for _, c := range []struct {
+		name      string
+		signer    crypto.Signer
+		responder *x509.Certificate
+		status    int
+		next      time.Time
+		revoked   bool
+		strict    bool
+	}{
+		{"good", ca.key, nil, ocsp.Good, now.Add(time.Hour), false, false},
+		{"revoked", ca.key, nil, ocsp.Revoked, now.Add(time.Hour), true, true},
+		{"unknown", ca.key, nil, ocsp.Unknown, now.Add(time.Hour), false, true},
+		{"stale revoked", ca.key, nil, ocsp.Revoked, now.Add(-time.Minute), false, true},
+		{"forged", other.key, nil, ocsp.Good, now.Add(time.Hour), true, true},
+		{"delegated", delegatedKey, delegated, ocsp.Good, now.Add(time.Hour), false, false},
+		{"not delegated", notDelegatedKey, notDelegated, ocsp.Good, now.Add(time.Hour), true, true},
+	} {
+		der := ocspTestResponse(t, ca, c.signer, c.responder, alice.Leaf, c.status, now.Add(-time.Hour), c.next)
+		if err := os.WriteFile(filepath.Join(dir, "3.der"), der, 0600); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := a.checkRevocation(ctx, chain); (err != nil) != c.revoked {
+			t.Fatalf("bad: %s: %v", c.name, err)
+		}
+		if err := strict.checkRevocation(ctx, chain); (err != nil) != c.strict {
+			t.Fatalf("bad: %s: strict: %v", c.name, err)
+		}
+	}
+}
+
+func TestServeConn_ClientCertPlainTCP(t *testing.T) {
+	// certificate authentication never applies without TLS
+	serv, err := New(&Config{
+		AuthMethods: []Authenticator{&ClientCertAuthenticator{}},
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+	defer serv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte{5, 1, NoAuth})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != noAcceptable {
+		t.Fatalf("bad: %v %v", reply, err)
+	}
+}
@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"log/slog"
+
+	"golang.org/x/net/context"
+)
+
+type contextKey int
+
+const (
+	connIDKey contextKey = iota
+	clientAddrKey
+	authContextKey
+	requestKey
+	loggerKey
+	tlsStateKey
+	listenerKey
+	peerCredKey
+)
+
+// withConn returns a context carrying the ID, client address and logger
+// of a connection
+func withConn(ctx context.Context, id uint64, client *AddrSpec, logger *slog.Logger) context.Context {
+	ctx = context.WithValue(ctx, connIDKey, id)
+	ctx = context.WithValue(ctx, clientAddrKey, client)
+	return withLogger(ctx, logger)
+}
+
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+func withAuthContext(ctx context.Context, authContext *AuthContext) context.Context {
+	return context.WithValue(ctx, authContextKey, authContext)
+}
+
+func withRequest(ctx context.Context, req *Request) context.Context {
+	return context.WithValue(ctx, requestKey, req)
+}
+
+// ConnID returns the ID of the connection a request context belongs to.
+// It matches the ID of the Session serving the request.
+func ConnID(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(connIDKey).(uint64)
+	return id, ok
+}
+
+// ClientAddr returns the address of the client of the connection a
+// request context belongs to
+func ClientAddr(ctx context.Context) (*AddrSpec, bool) {
+	addr, ok := ctx.Value(clientAddrKey).(*AddrSpec)
+	return addr, ok
+}
+
+// AuthInfo returns the AuthContext of the connection a request context
+// belongs to, once the client has authenticated
+func AuthInfo(ctx context.Context) (*AuthContext, bool) {
+	authContext, ok := ctx.Value(authContextKey).(*AuthContext)
+	return authContext, ok
+}
+
+// RequestFrom returns the Request being handled, e.g. to let Dial see
+// the destination as requested by the client
+func RequestFrom(ctx context.Context) (*Request, bool) {
+	req, ok := ctx.Value(requestKey).(*Request)
+	return req, ok
+}
+
+// Logger returns the logger of the connection a request context belongs
+// to, which adds conn_id, client, user and dest to every record, or
+// slog.Default() outside of a connection
+func Logger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,93 @@
+package socks5
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestServeConn_ConnContext(t *testing.T) {
+	var logs bytes.Buffer
+	rules := &recordingRules{}
+	serv := newTestServer(t, &Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		Rules:       rules,
+		Logger:      slog.New(slog.NewTextHandler(&logs, nil)),
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		serv.ServeConn(conn)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{
+		5, 1, UserPassAuth,
+		1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r',
+		5, 1, 0, 1, 127, 0, 0, 1, 0, 80,
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("ServeConn did not return")
+	}
+
+	seen := rules.last()
+	if !seen.hasID || seen.connID == 0 {
+		t.Fatalf("rules got no connection ID")
+	}
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if seen.client == nil || seen.client.Port != local.Port {
+		t.Fatalf("bad client address: %v", seen.client)
+	}
+	if seen.auth == nil || seen.auth.Payload["Username"] != "foo" {
+		t.Fatalf("bad auth context: %v", seen.auth)
+	}
+	if seen.req == nil || seen.req.DestAddr.Port != 80 {
+		t.Fatalf("bad request: %v", seen.req)
+	}
+	out := logs.String()
+	for _, want := range []string{
+		"msg=\"rule checked\" conn_id=" + strconv.FormatUint(seen.connID, 10),
+		"user=foo",
+		"dest=127.0.0.1:80",
+		"level=ERROR msg=\"socks request failed\"",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in logs:\n%s", want, out)
+		}
+	}
+}
+
+func TestLogger_Default(t *testing.T) {
+	if Logger(context.Background()) != slog.Default() {
+		t.Fatalf("expected the default logger outside of a connection")
+	}
+	if _, ok := ConnID(context.Background()); ok {
+		t.Fatalf("unexpected connection ID")
+	}
+	if _, ok := AuthInfo(context.Background()); ok {
+		t.Fatalf("unexpected auth context")
+	}
+}
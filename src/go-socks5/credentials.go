@@ -1,14 +1,19 @@
 package socks5
 
-// CredentialStore is used to support user/pass authentication
+import (
+	"golang.org/x/net/context"
+)
+
+// CredentialStore is used to support user/pass authentication. ctx is
+// the context of the connection being authenticated.
 type CredentialStore interface {
-	Valid(user, password string) bool
+	Valid(ctx context.Context, user, password string) bool
 }
 
 // StaticCredentials enables using a map directly as a credential store
 type StaticCredentials map[string]string
 
-func (s StaticCredentials) Valid(user, password string) bool {
+func (s StaticCredentials) Valid(ctx context.Context, user, password string) bool {
 	pass, ok := s[user]
 	if !ok {
 		return false
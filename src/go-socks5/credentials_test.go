@@ -2,6 +2,8 @@ package socks5
 
 import (
 	"testing"
+
+	"golang.org/x/net/context"
 )
 
 func TestStaticCredentials(t *testing.T) {
@@ -10,15 +12,15 @@ func TestStaticCredentials(t *testing.T) {
 		"baz": "",
 	}
 
-	if !creds.Valid("foo", "bar") {
+	if !creds.Valid(context.Background(), "foo", "bar") {
 		t.Fatalf("expect valid")
 	}
 
-	if !creds.Valid("baz", "") {
+	if !creds.Valid(context.Background(), "baz", "") {
 		t.Fatalf("expect valid")
 	}
 
-	if creds.Valid("foo", "") {
+	if creds.Valid(context.Background(), "foo", "") {
 		t.Fatalf("expect invalid")
 	}
 }
@@ -0,0 +1,477 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Defaults of CachingResolver
+const (
+	defaultDNSTimeout     = 5 * time.Second
+	defaultDNSNegativeTTL = 30 * time.Second
+	defaultDNSMaxTTL      = time.Hour
+	defaultDNSMaxEntries  = 10000
+	// EDNS0 payload size recommended by DNS Flag Day 2020
+	dnsUDPSize = 1232
+)
+
+// Address family preferences of CachingResolver
+const (
+	PreferIPv6 = "ipv6"
+	PreferIPv4 = "ipv4"
+	OnlyIPv6   = "ipv6-only"
+	OnlyIPv4   = "ipv4-only"
+)
+
+// ErrNameNotFound is returned for names that do not exist (NXDOMAIN)
+var ErrNameNotFound = fmt.Errorf("Name not found")
+
+// dnsServer is a parsed CachingResolver server
+type dnsServer struct {
+	// "udp", "tcp", "tls" or "https"
+	proto string
+	// host:port, or the URL for https
+	addr       string
+	serverName string
+}
+
+func parseDNSServer(s string) (*dnsServer, error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	server := &dnsServer{proto: u.Scheme, addr: u.Host}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Port() == "" {
+			server.addr = net.JoinHostPort(u.Hostname(), "53")
+		}
+	case "tls":
+		if u.Port() == "" {
+			server.addr = net.JoinHostPort(u.Hostname(), "853")
+		}
+		server.serverName = u.Query().Get("servername")
+		if server.serverName == "" {
+			server.serverName = u.Hostname()
+		}
+	case "https":
+		server.addr = u.String()
+	default:
+		return nil, fmt.Errorf("Unsupported DNS server %q, expected udp://, tcp://, tls:// or https://", s)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("Missing DNS server address in %q", s)
+	}
+	return server, nil
+}
+
+// dnsCacheEntry is a cached answer, or a cached failure if err is set
+type dnsCacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// CachingResolver is a NameResolver that queries DNS servers directly and
+// caches the answers for their TTL. Failures are cached for the SOA
+// minimum TTL of the response, or NegativeTTL.
+type CachingResolver struct {
+	// Servers are tried in order until one answers:
+	// "udp://host[:53]" (or just "host[:53]"), "tcp://host[:53]",
+	// "tls://host[:853][?servername=name]" (DNS over TLS) and
+	// "https://host/dns-query" (DNS over HTTPS). UDP answers that are
+	// truncated are retried over TCP.
+	Servers []string
+	// Timeout bounds each query to a server. Zero means 5s.
+	Timeout time.Duration
+	// Prefer is PreferIPv6 (the default), PreferIPv4, OnlyIPv6 or OnlyIPv4
+	Prefer string
+	// NegativeTTL is how long failures are cached when the server gives
+	// no SOA minimum. Zero means 30s, negative disables negative caching.
+	NegativeTTL time.Duration
+	// MaxTTL caps the time answers are cached. Zero means one hour.
+	MaxTTL time.Duration
+	// MaxEntries bounds the cache size. Zero means 10000.
+	MaxEntries int
+	// TLSConfig is used for DNS over TLS and HTTPS, e.g. to set root CAs
+	TLSConfig *tls.Config
+
+	servers []*dnsServer
+	client  *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*dnsCacheEntry
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewCachingResolver checks the configured servers and returns the resolver
+func NewCachingResolver(r *CachingResolver) (*CachingResolver, error) {
+	if len(r.Servers) == 0 {
+		return nil, fmt.Errorf("No DNS servers")
+	}
+	for _, s := range r.Servers {
+		server, err := parseDNSServer(s)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, server)
+	}
+	switch r.Prefer {
+	case "", PreferIPv6, PreferIPv4, OnlyIPv6, OnlyIPv4:
+	default:
+		return nil, fmt.Errorf("Unknown address family preference %q", r.Prefer)
+	}
+	if r.Timeout == 0 {
+		r.Timeout = defaultDNSTimeout
+	}
+	if r.NegativeTTL == 0 {
+		r.NegativeTTL = defaultDNSNegativeTTL
+	}
+	if r.MaxTTL == 0 {
+		r.MaxTTL = defaultDNSMaxTTL
+	}
+	if r.MaxEntries == 0 {
+		r.MaxEntries = defaultDNSMaxEntries
+	}
+	r.client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   r.TLSConfig,
+		ForceAttemptHTTP2: true,
+	}}
+	r.cache = make(map[string]*dnsCacheEntry)
+	r.now = time.Now
+	return r, nil
+}
+
+// Resolve implements the NameResolver interface.
+func (r *CachingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ips, err := r.ResolveAll(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+// ResolveAll implements the MultiResolver interface. The addresses of the
+// preferred family come first.
+func (r *CachingResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return ctx, []net.IP{ip}, nil
+	}
+	var types []dnsmessage.Type
+	switch r.Prefer {
+	case PreferIPv4:
+		types = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	case OnlyIPv4:
+		types = []dnsmessage.Type{dnsmessage.TypeA}
+	case OnlyIPv6:
+		types = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	default:
+		types = []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	}
+
+	// query the families in parallel
+	results := make([]*dnsCacheEntry, len(types))
+	var wg sync.WaitGroup
+	for i, qtype := range types {
+		wg.Add(1)
+		go func(i int, qtype dnsmessage.Type) {
+			defer wg.Done()
+			results[i] = r.lookup(ctx, name, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	var err error
+	for _, result := range results {
+		ips = append(ips, result.ips...)
+		if result.err != nil && err == nil {
+			err = result.err
+		}
+	}
+	if len(ips) == 0 {
+		if err == nil {
+			err = fmt.Errorf("No addresses for %s", name)
+		}
+		return ctx, nil, err
+	}
+	return ctx, ips, nil
+}
+
+// lookup returns the cached answer for name and qtype, querying the
+// servers if it is missing or expired
+func (r *CachingResolver) lookup(ctx context.Context, name string, qtype dnsmessage.Type) *dnsCacheEntry {
+	key := strings.ToLower(strings.TrimSuffix(name, ".")) + "/" + qtype.String()
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && r.now().Before(entry.expires) {
+		return entry
+	}
+
+	entry = r.query(ctx, name, qtype)
+	if entry.expires.IsZero() {
+		// not cacheable, e.g. every server failed
+		return entry
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= r.MaxEntries {
+		r.evict()
+	}
+	r.cache[key] = entry
+	return entry
+}
+
+// evict removes the expired entries, or an arbitrary one if none has
+// expired. Called with mu held.
+func (r *CachingResolver) evict() {
+	now := r.now()
+	for key, entry := range r.cache {
+		if !now.Before(entry.expires) {
+			delete(r.cache, key)
+		}
+	}
+	for key := range r.cache {
+		if len(r.cache) < r.MaxEntries {
+			break
+		}
+		delete(r.cache, key)
+	}
+}
+
+// query asks the servers in order until one answers
+func (r *CachingResolver) query(ctx context.Context, name string, qtype dnsmessage.Type) *dnsCacheEntry {
+	fqdn := name
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	qname, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return &dnsCacheEntry{err: err}
+	}
+	var errs []string
+	for _, server := range r.servers {
+		msg, err := r.exchange(ctx, server, qname, qtype)
+		if err == nil {
+			return r.parseAnswer(msg, qname, qtype)
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", server.addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return &dnsCacheEntry{err: fmt.Errorf("DNS query for %s failed: %s", name, strings.Join(errs, "; "))}
+}
+
+// parseAnswer turns a response into a cache entry
+func (r *CachingResolver) parseAnswer(msg *dnsmessage.Message, qname dnsmessage.Name, qtype dnsmessage.Type) *dnsCacheEntry {
+	now := r.now()
+	entry := &dnsCacheEntry{}
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		// SERVFAIL and the like are not cached
+		entry.err = fmt.Errorf("DNS query for %s failed: %v", qname, msg.RCode)
+		return entry
+	}
+
+	ttl := r.MaxTTL
+	for _, answer := range msg.Answers {
+		if answer.Header.Class != dnsmessage.ClassINET {
+			continue
+		}
+		var ip net.IP
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		}
+		if ip == nil || answer.Header.Type != qtype {
+			continue
+		}
+		entry.ips = append(entry.ips, ip)
+		if d := time.Duration(answer.Header.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	if len(entry.ips) > 0 {
+		entry.expires = now.Add(ttl)
+		return entry
+	}
+
+	if msg.RCode == dnsmessage.RCodeNameError {
+		entry.err = fmt.Errorf("%w: %s", ErrNameNotFound, strings.TrimSuffix(qname.String(), "."))
+	}
+	if r.NegativeTTL < 0 {
+		return entry
+	}
+	// RFC 2308: negative answers are cached for the SOA minimum
+	ttl = r.NegativeTTL
+	for _, authority := range msg.Authorities {
+		if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+			ttl = time.Duration(soa.MinTTL) * time.Second
+			if d := time.Duration(authority.Header.TTL) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+	}
+	if ttl > r.MaxTTL {
+		ttl = r.MaxTTL
+	}
+	entry.expires = now.Add(ttl)
+	return entry
+}
+
+// exchange sends one query to server and returns the matching response
+func (r *CachingResolver) exchange(ctx context.Context, server *dnsServer, qname dnsmessage.Name, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	var id [2]byte
+	if server.proto != "https" {
+		// RFC 8484 recommends ID 0 for caching by HTTP proxies
+		rand.Read(id[:])
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(dnsUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	query.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	switch server.proto {
+	case "udp":
+		raw, err = r.exchangeUDP(ctx, server.addr, packed)
+		if err == nil {
+			var h dnsmessage.Header
+			var p dnsmessage.Parser
+			if h, err = p.Start(raw); err == nil && h.Truncated {
+				raw, err = r.exchangeStream(ctx, "tcp", server, packed)
+			}
+		}
+	case "tcp", "tls":
+		raw, err = r.exchangeStream(ctx, server.proto, server, packed)
+	case "https":
+		raw, err = r.exchangeHTTPS(ctx, server.addr, packed)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(raw); err != nil {
+		return nil, err
+	}
+	if msg.ID != query.ID || !msg.Response || len(msg.Questions) != 1 ||
+		msg.Questions[0].Type != qtype || !strings.EqualFold(msg.Questions[0].Name.String(), qname.String()) {
+		return nil, fmt.Errorf("Mismatched DNS response")
+	}
+	return &msg, nil
+}
+
+func (r *CachingResolver) exchangeUDP(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray datagrams with another ID
+		if n >= 2 && bytes.Equal(buf[:2], query[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeStream sends a length-prefixed query over TCP or TLS
+func (r *CachingResolver) exchangeStream(ctx context.Context, proto string, server *dnsServer, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", server.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if proto == "tls" {
+		config := &tls.Config{}
+		if r.TLSConfig != nil {
+			config = r.TLSConfig.Clone()
+		}
+		config.ServerName = server.serverName
+		conn = tls.Client(conn, config)
+	}
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// exchangeHTTPS posts the query to a DNS over HTTPS server (RFC 8484)
+func (r *CachingResolver) exchangeHTTPS(ctx context.Context, url string, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS server returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
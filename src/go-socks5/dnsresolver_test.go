@@ -0,0 +1,366 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubDNS answers queries from a fixed zone and counts them
+type stubDNS struct {
+	mu       sync.Mutex
+	queries  map[string]int
+	truncate bool
+}
+
+func (s *stubDNS) count(qtype dnsmessage.Type) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[qtype.String()]
+}
+
+func (s *stubDNS) answer(raw []byte, udp bool) []byte {
+	var q dnsmessage.Message
+	if err := q.Unpack(raw); err != nil {
+		return nil
+	}
+	question := q.Questions[0]
+	s.mu.Lock()
+	if s.queries == nil {
+		s.queries = make(map[string]int)
+	}
+	s.queries[question.Type.String()]++
+	truncate := s.truncate && udp
+	s.mu.Unlock()
+
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.ID, Response: true, Truncated: truncate},
+		Questions: q.Questions,
+	}
+	header := func(ttl uint32) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+	switch question.Name.String() {
+	case "example.com.":
+		if truncate {
+			break
+		}
+		if question.Type == dnsmessage.TypeA {
+			resp.Answers = []dnsmessage.Resource{
+				{Header: header(60), Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}},
+				{Header: header(30), Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}}},
+			}
+		} else if question.Type == dnsmessage.TypeAAAA {
+			resp.Answers = []dnsmessage.Resource{
+				{Header: header(60), Body: &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}},
+			}
+		}
+	case "v4only.example.com.":
+		if question.Type == dnsmessage.TypeA {
+			resp.Answers = []dnsmessage.Resource{
+				{Header: header(60), Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 3}}},
+			}
+		}
+	default:
+		resp.RCode = dnsmessage.RCodeNameError
+		zone := dnsmessage.MustNewName("example.com.")
+		resp.Authorities = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body: &dnsmessage.SOAResource{
+				NS: dnsmessage.MustNewName("ns.example.com."), MBox: dnsmessage.MustNewName("hostmaster.example.com."),
+				MinTTL: 10,
+			},
+		}}
+	}
+	out, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// serve serves the stub over UDP and TCP on the same port
+func (s *stubDNS) serve(t *testing.T) string {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { udp.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(s.answer(buf[:n], true), addr)
+		}
+	}()
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+	go s.serveStream(tcp)
+	return udp.LocalAddr().String()
+}
+
+func (s *stubDNS) serveStream(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			length := make([]byte, 2)
+			if _, err := io.ReadFull(conn, length); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			resp := s.answer(query, false)
+			binary.BigEndian.PutUint16(length, uint16(len(resp)))
+			conn.Write(append(length, resp...))
+		}()
+	}
+}
+
+func newTestResolver(t *testing.T, r *CachingResolver) *CachingResolver {
+	r, err := NewCachingResolver(r)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return r
+}
+
+func TestCachingResolver_Cache(t *testing.T) {
+	stub := &stubDNS{}
+	r := newTestResolver(t, &CachingResolver{Servers: []string{stub.serve(t)}})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	_, ips, err := r.ResolveAll(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []string{"2001:db8::1", "192.0.2.1", "192.0.2.2"}
+	if len(ips) != len(expected) {
+		t.Fatalf("bad: %v", ips)
+	}
+	for i := range ips {
+		if ips[i].String() != expected[i] {
+			t.Fatalf("bad: %v", ips)
+		}
+	}
+
+	// answered from the cache
+	_, ip, err := r.Resolve(ctx, "Example.com.")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ip.String() != "2001:db8::1" {
+		t.Fatalf("bad: %v", ip)
+	}
+	if stub.count(dnsmessage.TypeA) != 1 || stub.count(dnsmessage.TypeAAAA) != 1 {
+		t.Fatalf("bad: %v", stub.queries)
+	}
+
+	// the A records expire with their lowest TTL
+	now = now.Add(31 * time.Second)
+	if _, _, err := r.ResolveAll(ctx, "example.com"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stub.count(dnsmessage.TypeA) != 2 || stub.count(dnsmessage.TypeAAAA) != 1 {
+		t.Fatalf("bad: %v", stub.queries)
+	}
+}
+
+func TestCachingResolver_NegativeCache(t *testing.T) {
+	stub := &stubDNS{}
+	r := newTestResolver(t, &CachingResolver{Servers: []string{"udp://" + stub.serve(t)}})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, _, err := r.ResolveAll(ctx, "missing.example.com")
+		if !errors.Is(err, ErrNameNotFound) {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+	if stub.count(dnsmessage.TypeA) != 1 {
+		t.Fatalf("bad: %v", stub.queries)
+	}
+
+	// cached for the SOA minimum
+	now = now.Add(11 * time.Second)
+	r.ResolveAll(ctx, "missing.example.com")
+	if stub.count(dnsmessage.TypeA) != 2 {
+		t.Fatalf("bad: %v", stub.queries)
+	}
+
+	// an empty answer is cached too
+	_, ips, err := r.ResolveAll(ctx, "v4only.example.com")
+	if err != nil || len(ips) != 1 || ips[0].String() != "192.0.2.3" {
+		t.Fatalf("bad: %v %v", ips, err)
+	}
+	r.ResolveAll(ctx, "v4only.example.com")
+	if stub.count(dnsmessage.TypeAAAA) != 3 {
+		t.Fatalf("bad: %v", stub.queries)
+	}
+}
+
+func TestCachingResolver_Prefer(t *testing.T) {
+	stub := &stubDNS{}
+	addr := stub.serve(t)
+	ctx := context.Background()
+
+	r := newTestResolver(t, &CachingResolver{Servers: []string{addr}, Prefer: PreferIPv4})
+	_, ips, err := r.ResolveAll(ctx, "example.com")
+	if err != nil || len(ips) != 3 || ips[0].String() != "192.0.2.1" || ips[2].String() != "2001:db8::1" {
+		t.Fatalf("bad: %v %v", ips, err)
+	}
+
+	r = newTestResolver(t, &CachingResolver{Servers: []string{addr}, Prefer: OnlyIPv6})
+	_, ips, err = r.ResolveAll(ctx, "example.com")
+	if err != nil || len(ips) != 1 || ips[0].String() != "2001:db8::1" {
+		t.Fatalf("bad: %v %v", ips, err)
+	}
+	if _, _, err := r.ResolveAll(ctx, "v4only.example.com"); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if _, err := NewCachingResolver(&CachingResolver{Servers: []string{addr}, Prefer: "ipv5"}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestCachingResolver_TCPFallback(t *testing.T) {
+	stub := &stubDNS{truncate: true}
+	r := newTestResolver(t, &CachingResolver{Servers: []string{stub.serve(t)}, Prefer: OnlyIPv4})
+	_, ip, err := r.Resolve(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ip.String() != "192.0.2.1" {
+		t.Fatalf("bad: %v", ip)
+	}
+	// once over UDP, once over TCP
+	if stub.count(dnsmessage.TypeA) != 2 {
+		t.Fatalf("bad: %v", stub.queries)
+	}
+}
+
+func TestCachingResolver_Failover(t *testing.T) {
+	// nothing listens on the first server
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dead.Close()
+
+	stub := &stubDNS{}
+	r := newTestResolver(t, &CachingResolver{
+		Servers: []string{"tcp://" + dead.LocalAddr().String(), "tcp://" + stub.serve(t)},
+		Timeout: time.Second,
+		Prefer:  OnlyIPv4,
+	})
+	_, ip, err := r.Resolve(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ip.String() != "192.0.2.1" {
+		t.Fatalf("bad: %v", ip)
+	}
+}
+
+func TestCachingResolver_Timeout(t *testing.T) {
+	// a server that never answers
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer udp.Close()
+
+	r := newTestResolver(t, &CachingResolver{
+		Servers: []string{udp.LocalAddr().String()},
+		Timeout: 50 * time.Millisecond,
+	})
+	start := time.Now()
+	if _, _, err := r.ResolveAll(context.Background(), "example.com"); err == nil {
+		t.Fatalf("expected error")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("timeout not applied")
+	}
+}
+
+func TestCachingResolver_TLS(t *testing.T) {
+	stub := &stubDNS{}
+
+	// DNS over HTTPS
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(stub.answer(query, false))
+	}))
+	defer doh.Close()
+	tlsConfig := doh.Client().Transport.(*http.Transport).TLSClientConfig
+
+	// DNS over TLS with the same certificate
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: doh.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go stub.serveStream(l)
+
+	for _, server := range []string{doh.URL + "/dns-query", "tls://" + l.Addr().String() + "?servername=example.com"} {
+		r := newTestResolver(t, &CachingResolver{Servers: []string{server}, TLSConfig: tlsConfig})
+		_, ips, err := r.ResolveAll(context.Background(), "example.com")
+		if err != nil {
+			t.Fatalf("%s: %v", server, err)
+		}
+		if len(ips) != 3 {
+			t.Fatalf("bad: %v", ips)
+		}
+	}
+}
+
+func TestParseDNSServer(t *testing.T) {
+	for in, expected := range map[string]string{
+		"1.1.1.1":                          "udp 1.1.1.1:53",
+		"tcp://[2001:db8::1]":              "tcp [2001:db8::1]:53",
+		"tls://1.1.1.1?servername=one.one": "tls 1.1.1.1:853",
+		"https://dns.example/dns-query":    "https https://dns.example/dns-query",
+	} {
+		s, err := parseDNSServer(in)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if s.proto+" "+s.addr != expected {
+			t.Fatalf("bad: %s: %s %s", in, s.proto, s.addr)
+		}
+	}
+	if _, err := parseDNSServer("ftp://1.1.1.1"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
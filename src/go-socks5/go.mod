@@ -2,4 +2,7 @@ module github.com/armon/go-socks5
 
 go 1.22.3
 
-require golang.org/x/net v0.25.0
+require (
+	golang.org/x/crypto v0.23.0
+	golang.org/x/net v0.25.0
+)
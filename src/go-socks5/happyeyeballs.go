@@ -0,0 +1,119 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// defaultFallbackDelay is the Connection Attempt Delay recommended by
+// RFC 8305
+const defaultFallbackDelay = 250 * time.Millisecond
+
+// interleaveFamilies orders addresses alternating between IPv6 and IPv4,
+// starting with the family of the first one and otherwise keeping the
+// resolver's order (RFC 8305, section 4)
+func interleaveFamilies(ips []net.IP) []net.IP {
+	if len(ips) == 0 {
+		return ips
+	}
+	var first, second []net.IP
+	for _, ip := range ips {
+		if SameFamily(ip, ips[0]) {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	out := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// SameFamily reports whether a and b are both IPv4 or both IPv6
+func SameFamily(a, b net.IP) bool {
+	return (a.To4() == nil) == (b.To4() == nil)
+}
+
+// dialResult is the outcome of one connection attempt
+type dialResult struct {
+	conn net.Conn
+	addr string
+	err  error
+}
+
+// dialHappyEyeballs connects to the first of addrs that answers. An
+// attempt is started whenever the previous one fails or has not
+// succeeded within FallbackDelay (RFC 8305, section 5); a negative
+// delay tries the addresses one after another.
+func (s *Server) dialHappyEyeballs(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), addrs []string) (net.Conn, string, error) {
+	delay := s.config.FallbackDelay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+	logger := Logger(ctx)
+
+	// losing attempts are cancelled once one succeeds
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	var fallback <-chan time.Time
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		logger.Debug("connecting", "addr", addr)
+		go func() {
+			conn, err := dial(ctx, "tcp", addr)
+			results <- dialResult{conn, addr, err}
+		}()
+		fallback = nil
+		if delay > 0 && next < len(addrs) {
+			fallback = time.After(delay)
+		}
+	}
+
+	start()
+	var failures []string
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close connections that complete after the winner
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				if next > 1 {
+					logger.Info("connected after trying several addresses",
+						"addr", r.addr, "tried", addrs[:next], "failures", failures)
+				}
+				return r.conn, r.addr, nil
+			}
+			logger.Debug("connection attempt failed", "addr", r.addr, "err", r.err)
+			failures = append(failures, fmt.Sprintf("%s: %v", r.addr, r.err))
+			if next < len(addrs) {
+				start()
+			}
+		case <-fallback:
+			start()
+		}
+	}
+	return nil, "", fmt.Errorf("%s", strings.Join(failures, "; "))
+}
@@ -0,0 +1,178 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("2001:db8::3"),
+		net.ParseIP("192.0.2.1"),
+	}
+	out := interleaveFamilies(ips)
+	expected := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "2001:db8::3"}
+	if len(out) != len(expected) {
+		t.Fatalf("bad: %v", out)
+	}
+	for i := range out {
+		if out[i].String() != expected[i] {
+			t.Fatalf("bad: %v", out)
+		}
+	}
+}
+
+func TestDialHappyEyeballs_Fallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	// the first address never answers
+	blackholeDone := make(chan struct{})
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "blackhole:1" {
+			<-ctx.Done()
+			close(blackholeDone)
+			return nil, ctx.Err()
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	s := &Server{config: &Config{FallbackDelay: 10 * time.Millisecond}}
+	conn, addr, err := s.dialHappyEyeballs(context.Background(), dial, []string{"blackhole:1", l.Addr().String()})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+	if addr != l.Addr().String() {
+		t.Fatalf("bad: %v", addr)
+	}
+	select {
+	case <-blackholeDone:
+	case <-time.After(time.Second):
+		t.Fatalf("losing attempt not cancelled")
+	}
+}
+
+func TestDialHappyEyeballs_AllFail(t *testing.T) {
+	var mu sync.Mutex
+	var tried []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		tried = append(tried, addr)
+		mu.Unlock()
+		return nil, fmt.Errorf("connection refused")
+	}
+	s := &Server{config: &Config{FallbackDelay: -1}}
+	_, _, err := s.dialHappyEyeballs(context.Background(), dial, []string{"a:1", "b:1", "c:1"})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	for _, addr := range []string{"a:1", "b:1", "c:1"} {
+		if !strings.Contains(err.Error(), addr+": connection refused") {
+			t.Fatalf("bad: %v", err)
+		}
+	}
+	if strings.Join(tried, ",") != "a:1,b:1,c:1" {
+		t.Fatalf("bad order: %v", tried)
+	}
+}
+
+// multiResolver resolves every name to a fixed list of addresses
+type multiResolver []net.IP
+
+func (r multiResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, r[0], nil
+}
+
+func (r multiResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	return ctx, r, nil
+}
+
+// denyIP blocks connections to one address
+type denyIP struct {
+	ip net.IP
+}
+
+func (d denyIP) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return ctx, !req.DestAddr.IP.Equal(d.ip)
+}
+
+func TestRequest_Connect_MultipleAddresses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("pong"))
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	var mu sync.Mutex
+	var tried []string
+	s := &Server{config: &Config{
+		// 192.0.2.1 is denied, 192.0.2.2 refuses, 127.0.0.1 answers
+		Resolver: multiResolver{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("127.0.0.1")},
+		Rules:    denyIP{net.ParseIP("192.0.2.1")},
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			tried = append(tried, addr)
+			mu.Unlock()
+			if strings.HasPrefix(addr, "192.0.2.") {
+				return nil, fmt.Errorf("connection refused")
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 3, 7})
+	buf.WriteString("example")
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+	buf.Write(port)
+
+	resp := &MockConn{}
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := s.handleRequest(context.Background(), req, resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out := resp.buf.Bytes(); out[1] != successReply || !bytes.HasSuffix(out, []byte("pong")) {
+		t.Fatalf("bad: %v", out)
+	}
+	if !req.DestAddr.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("bad: %v", req.DestAddr)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, addr := range tried {
+		if strings.HasPrefix(addr, "192.0.2.1:") {
+			t.Fatalf("dialed a denied address: %v", tried)
+		}
+	}
+}
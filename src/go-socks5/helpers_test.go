@@ -0,0 +1,95 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// seenRequest is what a RuleSet sees of a request and its connection
+type seenRequest struct {
+	connID   uint64
+	hasID    bool
+	client   *AddrSpec
+	remote   string
+	auth     *AuthContext
+	user     string
+	subject  string
+	listener string
+	tls      bool
+	cred     *PeerCred
+	req      *Request
+}
+
+// recordingRules records what the rules see of the last request, logs
+// it through the connection logger, and allows it if allow is set
+type recordingRules struct {
+	allow bool
+
+	mu   sync.Mutex
+	seen seenRequest
+}
+
+func (r *recordingRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	seen := seenRequest{listener: ListenerName(ctx)}
+	seen.connID, seen.hasID = ConnID(ctx)
+	seen.client, _ = ClientAddr(ctx)
+	seen.auth, _ = AuthInfo(ctx)
+	_, seen.tls = TLSConnectionState(ctx)
+	seen.cred, _ = PeerCredentials(ctx)
+	seen.req, _ = RequestFrom(ctx)
+	if req.RemoteAddr != nil {
+		seen.remote = req.RemoteAddr.Address()
+	}
+	if req.AuthContext != nil {
+		seen.user = req.AuthContext.Payload["Username"]
+		seen.subject = req.AuthContext.Payload[ClientCertPayload]
+	}
+	r.mu.Lock()
+	r.seen = seen
+	r.mu.Unlock()
+	Logger(ctx).Info("rule checked")
+	return ctx, r.allow
+}
+
+// last returns what the rules saw of the last request
+func (r *recordingRules) last() seenRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.seen
+}
+
+// newTestServer creates a server from conf, closed with the test
+func newTestServer(t *testing.T, conf *Config) *Server {
+	serv, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { serv.Close() })
+	return serv
+}
+
+// serveListener serves conf on a new local listener and returns its
+// address
+func serveListener(t *testing.T, serv *Server, conf *ListenerConfig) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.ServeListener(l, conf)
+	return l.Addr().String()
+}
+
+// startTLSServer serves conf over TLS and returns the listener address
+func startTLSServer(t *testing.T, conf *Config, tlsConfig *tls.Config) string {
+	serv := newTestServer(t, conf)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.ServeTLS(l, tlsConfig)
+	return l.Addr().String()
+}
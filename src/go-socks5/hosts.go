@@ -0,0 +1,187 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// HostsResolver answers the names listed in Hosts with fixed addresses
+// and passes the others to Resolver.
+//
+// If NAT64Prefix is set, the proxy is assumed to reach IPv4 only through
+// NAT64: names without an IPv6 address get IPv4-embedded addresses in the
+// prefix (RFC 6052) instead of their global IPv4 ones, as a DNS64 server
+// would. Rules then see the synthesized address; NAT64Extract recovers
+// the IPv4 destination it stands for.
+type HostsResolver struct {
+	// Hosts maps lowercase names, without the trailing dot, to addresses
+	Hosts       map[string][]net.IP
+	Resolver    NameResolver
+	NAT64Prefix *net.IPNet
+}
+
+// Resolve implements the NameResolver interface.
+func (h *HostsResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ips, err := h.ResolveAll(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+// ResolveAll implements the MultiResolver interface.
+func (h *HostsResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	ips, ok := h.Hosts[strings.ToLower(strings.TrimSuffix(name, "."))]
+	if !ok {
+		var err error
+		if resolver, ok := h.Resolver.(MultiResolver); ok {
+			ctx, ips, err = resolver.ResolveAll(ctx, name)
+		} else {
+			var ip net.IP
+			ctx, ip, err = h.Resolver.Resolve(ctx, name)
+			ips = []net.IP{ip}
+		}
+		if err != nil {
+			return ctx, nil, err
+		}
+	}
+	if h.NAT64Prefix != nil {
+		ips = h.synthesize(ips)
+	}
+	if len(ips) == 0 {
+		return ctx, nil, fmt.Errorf("No addresses for %s", name)
+	}
+	return ctx, ips, nil
+}
+
+// synthesize keeps the IPv6 addresses, or maps the global IPv4 ones into
+// the NAT64 prefix if there are none
+func (h *HostsResolver) synthesize(ips []net.IP) []net.IP {
+	var v6, v4 []net.IP
+	for _, ip := range ips {
+		switch {
+		case ip.To4() == nil:
+			v6 = append(v6, ip)
+		case nat64Global(ip):
+			v4 = append(v4, NAT64Synthesize(h.NAT64Prefix, ip))
+		default:
+			v4 = append(v4, ip)
+		}
+	}
+	if len(v6) > 0 {
+		return v6
+	}
+	return v4
+}
+
+// ParseNAT64Prefix parses a NAT64 prefix such as the well-known
+// 64:ff9b::/96. The lengths of RFC 6052 are accepted: 32, 40, 48, 56, 64
+// and 96.
+func ParseNAT64Prefix(s string) (*net.IPNet, error) {
+	ip, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("NAT64 prefix %s is not IPv6", s)
+	}
+	switch ones, _ := prefix.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("Invalid NAT64 prefix length %d, expected 32, 40, 48, 56, 64 or 96", ones)
+	}
+	return prefix, nil
+}
+
+// nat64Positions returns the bytes of an address in prefix that hold the
+// embedded IPv4 address; byte 8 (bits 64 to 71) is always skipped
+func nat64Positions(prefix *net.IPNet) [4]int {
+	ones, _ := prefix.Mask.Size()
+	var positions [4]int
+	pos := ones / 8
+	for i := range positions {
+		if pos == 8 {
+			pos++
+		}
+		positions[i] = pos
+		pos++
+	}
+	return positions
+}
+
+// NAT64Synthesize embeds an IPv4 address in a NAT64 prefix
+func NAT64Synthesize(prefix *net.IPNet, ip net.IP) net.IP {
+	v4 := ip.To4()
+	if v4 == nil {
+		return ip
+	}
+	out := make(net.IP, net.IPv6len)
+	copy(out, prefix.IP.To16())
+	for i, pos := range nat64Positions(prefix) {
+		out[pos] = v4[i]
+	}
+	return out
+}
+
+// nat64Global reports whether ip is an IPv4 address NAT64 may stand for:
+// a global unicast one, not private or loopback (RFC 6052, section 3.1)
+func nat64Global(ip net.IP) bool {
+	return ip.To4() != nil && ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// NAT64Address maps the host of addr, a "host:port" string, into prefix
+// if it is a global IPv4 address, and returns addr unchanged otherwise.
+// It is meant for dialers connecting directly from an IPv6-only network.
+func NAT64Address(prefix *net.IPNet, addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	ip := net.ParseIP(host)
+	if !nat64Global(ip) {
+		return addr
+	}
+	return net.JoinHostPort(NAT64Synthesize(prefix, ip).String(), port)
+}
+
+// NAT64Extract returns the IPv4 address embedded in ip, or nil if ip is
+// not in the NAT64 prefix
+func NAT64Extract(prefix *net.IPNet, ip net.IP) net.IP {
+	if ip.To4() != nil || !prefix.Contains(ip) {
+		return nil
+	}
+	ip = ip.To16()
+	v4 := make(net.IP, net.IPv4len)
+	for i, pos := range nat64Positions(prefix) {
+		v4[i] = ip[pos]
+	}
+	return v4
+}
+
+// ParseHosts reads a hosts file: an address followed by its names on each
+// line, with comments starting with '#'
+func ParseHosts(r io.Reader) (map[string][]net.IP, error) {
+	hosts := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("Invalid hosts entry on line %d: %q", line, scanner.Text())
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return hosts, scanner.Err()
+}
@@ -0,0 +1,178 @@
+package socks5
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestHostsResolver(t *testing.T) {
+	hosts, err := ParseHosts(strings.NewReader(`
+# comment
+192.0.2.10 cache.example.org Cache2.example.org.
+2001:db8::10 cache.example.org # both families
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	r := &HostsResolver{
+		Hosts:    hosts,
+		Resolver: multiResolver{net.ParseIP("192.0.2.1")},
+	}
+	ctx := context.Background()
+
+	_, ips, err := r.ResolveAll(ctx, "CACHE.example.org.")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ips) != 2 || ips[0].String() != "192.0.2.10" || ips[1].String() != "2001:db8::10" {
+		t.Fatalf("bad: %v", ips)
+	}
+	_, ip, err := r.Resolve(ctx, "cache2.example.org")
+	if err != nil || ip.String() != "192.0.2.10" {
+		t.Fatalf("bad: %v %v", ip, err)
+	}
+	// other names go to the resolver
+	_, ip, err = r.Resolve(ctx, "example.com")
+	if err != nil || ip.String() != "192.0.2.1" {
+		t.Fatalf("bad: %v %v", ip, err)
+	}
+
+	if _, err := ParseHosts(strings.NewReader("cache.example.org\n")); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestHostsResolver_NAT64(t *testing.T) {
+	prefix, err := ParseNAT64Prefix("64:ff9b::/96")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	r := &HostsResolver{
+		Hosts: map[string][]net.IP{
+			"dual.example.org":  {net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8::10")},
+			"intra.example.org": {net.ParseIP("10.0.0.1")},
+		},
+		Resolver:    multiResolver{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")},
+		NAT64Prefix: prefix,
+	}
+	ctx := context.Background()
+
+	// IPv4-only names are synthesized
+	_, ips, err := r.ResolveAll(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ips) != 2 || ips[0].String() != "64:ff9b::c000:201" || ips[1].String() != "64:ff9b::c000:202" {
+		t.Fatalf("bad: %v", ips)
+	}
+	// native IPv6 is preferred
+	_, ips, err = r.ResolveAll(ctx, "dual.example.org")
+	if err != nil || len(ips) != 1 || ips[0].String() != "2001:db8::10" {
+		t.Fatalf("bad: %v %v", ips, err)
+	}
+	// private addresses have no NAT64 equivalent
+	_, ips, err = r.ResolveAll(ctx, "intra.example.org")
+	if err != nil || len(ips) != 1 || ips[0].String() != "10.0.0.1" {
+		t.Fatalf("bad: %v %v", ips, err)
+	}
+}
+
+func TestNAT64(t *testing.T) {
+	// examples of RFC 6052, section 2.4
+	for prefix, expected := range map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::192.0.2.33",
+	} {
+		p, err := ParseNAT64Prefix(prefix)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		ip := NAT64Synthesize(p, net.ParseIP("192.0.2.33"))
+		if !ip.Equal(net.ParseIP(expected)) {
+			t.Fatalf("bad: %s: %v", prefix, ip)
+		}
+		if v4 := NAT64Extract(p, ip); v4.String() != "192.0.2.33" {
+			t.Fatalf("bad: %s: %v", prefix, v4)
+		}
+	}
+
+	p, _ := ParseNAT64Prefix("64:ff9b::/96")
+	if v4 := NAT64Extract(p, net.ParseIP("2001:db8::1")); v4 != nil {
+		t.Fatalf("bad: %v", v4)
+	}
+	if v4 := NAT64Extract(p, net.ParseIP("192.0.2.1")); v4 != nil {
+		t.Fatalf("bad: %v", v4)
+	}
+	for _, prefix := range []string{"64:ff9b::/80", "192.0.2.0/24"} {
+		if _, err := ParseNAT64Prefix(prefix); err == nil {
+			t.Fatalf("expected error for %s", prefix)
+		}
+	}
+}
+
+func TestNAT64Address(t *testing.T) {
+	prefix, err := ParseNAT64Prefix("64:ff9b::/96")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for addr, expected := range map[string]string{
+		"149.154.167.51:443":  "[64:ff9b::959a:a733]:443",
+		"[2001:db8::1]:443":   "[2001:db8::1]:443",
+		"example.com:443":     "example.com:443",
+		"127.0.0.1:443":       "127.0.0.1:443",
+		"10.1.2.3:443":        "10.1.2.3:443",
+		"192.168.1.1:443":     "192.168.1.1:443",
+		"169.254.1.1:443":     "169.254.1.1:443",
+		"0.0.0.0:443":         "0.0.0.0:443",
+		"not an address":      "not an address",
+		"[64:ff9b::1]:443":    "[64:ff9b::1]:443",
+		"203.0.113.5:8080":    "[64:ff9b::cb00:7105]:8080",
+		"255.255.255.255:443": "255.255.255.255:443",
+	} {
+		if got := NAT64Address(prefix, addr); got != expected {
+			t.Fatalf("bad: %s: %s", addr, got)
+		}
+	}
+}
+
+func TestRequest_NAT64(t *testing.T) {
+	prefix, err := ParseNAT64Prefix("64:ff9b::/96")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var dialed string
+	s := &Server{config: &Config{
+		Rules:       PermitAll(),
+		Resolver:    DNSResolver{},
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		NAT64Prefix: prefix,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = addr
+			return nil, fmt.Errorf("connection refused")
+		},
+	}}
+	// a custom Dial maps addresses itself, and the mapping is no rewrite
+	req, err := NewRequest(bytes.NewReader([]byte{5, 1, 0, 1, 149, 154, 167, 51, 1, 187}))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	s.handleRequest(context.Background(), req, resp)
+	if dialed != "149.154.167.51:443" || req.Rewritten() {
+		t.Fatalf("bad: %s %v", dialed, req.Rewritten())
+	}
+	if out := resp.buf.Bytes(); len(out) < 2 || out[1] != connectionRefused {
+		t.Fatalf("bad: %v", out)
+	}
+}
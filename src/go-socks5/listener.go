@@ -0,0 +1,94 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"net"
+
+	"golang.org/x/net/context"
+)
+
+// ListenerConfig overrides parts of Config for the connections accepted
+// by one listener, so a single Server, with its sessions, can apply a
+// different policy per listener
+type ListenerConfig struct {
+	// Name identifies the listener, it is added to the records of its
+	// connections and to their Session
+	Name string
+
+	// AuthMethods replaces Config.AuthMethods if not empty
+	AuthMethods []Authenticator
+
+	// Rules replaces Config.Rules if provided
+	Rules RuleSet
+
+	// AllowClient, if provided, is called with the address of the
+	// client of every accepted connection. The connection is closed
+	// before the handshake unless it returns true.
+	AllowClient func(addr net.Addr) bool
+
+	// TrustProxy, if provided, enables the PROXY protocol v1 and v2 for
+	// the connections from the addresses it returns true for, e.g. a load
+	// balancer. They must start with a PROXY protocol header, and the
+	// source address it carries is used as the client address. Other
+	// connections are served as they are.
+	TrustProxy func(addr net.Addr) bool
+
+	// TLSConfig, if provided, serves SOCKS over TLS on the listener,
+	// which is then given plain connections rather than a listener from
+	// tls.NewListener: the TLS handshake follows the PROXY protocol
+	// header, which a load balancer sends in the clear.
+	TLSConfig *tls.Config
+}
+
+// listenerPolicy is a ListenerConfig prepared for serving
+type listenerPolicy struct {
+	*ListenerConfig
+	authMethods map[uint8]Authenticator
+}
+
+func newListenerPolicy(conf *ListenerConfig) *listenerPolicy {
+	p := &listenerPolicy{ListenerConfig: conf}
+	if len(conf.AuthMethods) > 0 {
+		p.authMethods = make(map[uint8]Authenticator)
+		for _, a := range conf.AuthMethods {
+			p.authMethods[a.GetCode()] = a
+		}
+	}
+	return p
+}
+
+// ServeListener is used to serve connections from a listener with the
+// policy of conf
+func (s *Server) ServeListener(l net.Listener, conf *ListenerConfig) error {
+	return s.serve(l, newListenerPolicy(conf))
+}
+
+func withListener(ctx context.Context, p *listenerPolicy) context.Context {
+	return context.WithValue(ctx, listenerKey, p)
+}
+
+// ListenerName returns the name of the listener that accepted the
+// connection a request context belongs to, empty for Serve
+func ListenerName(ctx context.Context) string {
+	if p, ok := ctx.Value(listenerKey).(*listenerPolicy); ok {
+		return p.Name
+	}
+	return ""
+}
+
+// rules returns the RuleSet applying to the connection of ctx
+func (s *Server) rules(ctx context.Context) RuleSet {
+	if p, ok := ctx.Value(listenerKey).(*listenerPolicy); ok && p.Rules != nil {
+		return p.Rules
+	}
+	return s.config.Rules
+}
+
+// authenticators returns the auth methods offered on the connection of
+// ctx
+func (s *Server) authenticators(ctx context.Context) map[uint8]Authenticator {
+	if p, ok := ctx.Value(listenerKey).(*listenerPolicy); ok && p.authMethods != nil {
+		return p.authMethods
+	}
+	return s.authMethods
+}
@@ -0,0 +1,92 @@
+package socks5
+
+import (
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_ServeListener(t *testing.T) {
+	// Create a local listener that holds the connection open
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+	tAddr := target.Addr().(*net.TCPAddr)
+
+	serv := newTestServer(t, &Config{
+		Credentials:  StaticCredentials{"foo": "bar"},
+		Rules:        PermitNone(),
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		AccessLogger: log.New(io.Discard, "", 0),
+	})
+
+	rules := &recordingRules{allow: true}
+	public := serveListener(t, serv, &ListenerConfig{Name: "public"})
+	local := serveListener(t, serv, &ListenerConfig{
+		Name:        "local",
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+		Rules:       rules,
+		AllowClient: func(addr net.Addr) bool {
+			return addr.(*net.TCPAddr).IP.IsLoopback()
+		},
+	})
+	blocked := serveListener(t, serv, &ListenerConfig{
+		Name:        "blocked",
+		AllowClient: func(addr net.Addr) bool { return false },
+	})
+
+	dial := func(addr string) net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		return conn
+	}
+
+	// the server's auth methods apply without an override
+	conn := dial(public)
+	defer conn.Close()
+	conn.Write([]byte{5, 1, NoAuth})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != noAcceptable {
+		t.Fatalf("bad: %v %v", reply, err)
+	}
+
+	// the listener's methods and rules replace the server's
+	conn = dial(local)
+	defer conn.Close()
+	conn.Write([]byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, byte(tAddr.Port >> 8), byte(tAddr.Port)})
+	reply = make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != NoAuth || reply[3] != successReply {
+		t.Fatalf("bad: %v %v", reply, err)
+	}
+	if listener := rules.last().listener; listener != "local" {
+		t.Fatalf("bad: %q", listener)
+	}
+	sessions := serv.Sessions()
+	if len(sessions) != 1 || sessions[0].Listener != "local" {
+		t.Fatalf("bad: %v", sessions)
+	}
+
+	// clients that are not allowed are dropped before the handshake
+	conn = dial(blocked)
+	defer conn.Close()
+	conn.Write([]byte{5, 1, NoAuth})
+	if n, err := conn.Read(reply); n != 0 || err == nil {
+		t.Fatalf("bad: %v %v", reply[:n], err)
+	}
+}
@@ -0,0 +1,73 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"os/user"
+	"strconv"
+
+	"golang.org/x/net/context"
+)
+
+// PeerCred holds the credentials of the process at the other end of a
+// Unix socket connection
+type PeerCred struct {
+	PID int
+	UID int
+	GID int
+}
+
+// PeerCredentials returns the peer credentials of the connection a
+// request context belongs to, if it came over a Unix socket on a system
+// that supports them
+func PeerCredentials(ctx context.Context) (*PeerCred, bool) {
+	cred, ok := ctx.Value(peerCredKey).(*PeerCred)
+	return cred, ok
+}
+
+// unixPeerCred returns the peer credentials of conn, or nil if it is not
+// a Unix socket connection or they are not available
+func unixPeerCred(conn net.Conn) *PeerCred {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	cred, err := getPeerCred(unixConn)
+	if err != nil {
+		return nil
+	}
+	return cred
+}
+
+// PeerCredAuthenticator authenticates the clients of Unix sockets as the
+// local user their process runs as, without asking for a password. It
+// uses the "No Auth" method code and is skipped on other connections,
+// so it can be combined with UserPassAuthenticator.
+type PeerCredAuthenticator struct{}
+
+func (a PeerCredAuthenticator) GetCode() uint8 {
+	return NoAuth
+}
+
+// Applicable implements ConditionalAuthenticator
+func (a PeerCredAuthenticator) Applicable(ctx context.Context) bool {
+	_, ok := PeerCredentials(ctx)
+	return ok
+}
+
+// Authenticate reports the name of the user, or the UID if it has none
+func (a PeerCredAuthenticator) Authenticate(ctx context.Context, reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	cred, _ := PeerCredentials(ctx)
+	if _, err := writer.Write([]byte{socks5Version, NoAuth}); err != nil {
+		return nil, err
+	}
+	username := strconv.Itoa(cred.UID)
+	if u, err := user.LookupId(username); err == nil {
+		username = u.Username
+	}
+	return &AuthContext{NoAuth, map[string]string{"Username": username}}, nil
+}
@@ -0,0 +1,25 @@
+package socks5
+
+import (
+	"net"
+	"syscall"
+)
+
+// getPeerCred reads SO_PEERCRED of conn
+func getPeerCred(conn *net.UnixConn) (*PeerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	ctrlErr := raw.Control(func(fd uintptr) {
+		ucred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if ctrlErr != nil {
+		return nil, ctrlErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &PeerCred{PID: int(ucred.Pid), UID: int(ucred.Uid), GID: int(ucred.Gid)}, nil
+}
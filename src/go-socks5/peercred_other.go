@@ -0,0 +1,12 @@
+//go:build !linux
+
+package socks5
+
+import (
+	"fmt"
+	"net"
+)
+
+func getPeerCred(conn *net.UnixConn) (*PeerCred, error) {
+	return nil, fmt.Errorf("Peer credentials are not supported on this system")
+}
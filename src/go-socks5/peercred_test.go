@@ -0,0 +1,101 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPeerCredAuthenticator(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	path := filepath.Join(t.TempDir(), "socks.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	rules := &recordingRules{}
+	var access bytes.Buffer
+	var accessMu sync.Mutex
+	serv := newTestServer(t, &Config{
+		AuthMethods: []Authenticator{
+			PeerCredAuthenticator{},
+			&UserPassAuthenticator{StaticCredentials{"foo": "bar"}},
+		},
+		Rules:        rules,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		AccessLogger: log.New(lockedWriter{&accessMu, &access}, "", 0),
+	})
+	go serv.Serve(l)
+	go serv.Serve(tcp)
+	defer serv.Close()
+
+	request := func(network, addr string) byte {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte{5, 1, NoAuth})
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if reply[1] == NoAuth {
+			conn.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+			io.ReadAll(conn)
+		}
+		return reply[1]
+	}
+
+	if method := request("unix", path); method != NoAuth {
+		t.Fatalf("bad: %v", method)
+	}
+	username := strconv.Itoa(os.Getuid())
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	if seen := rules.last(); seen.user != username || seen.cred == nil || seen.cred.UID != os.Getuid() || seen.cred.PID != os.Getpid() {
+		t.Fatalf("bad: %q %+v", seen.user, seen.cred)
+	}
+	accessMu.Lock()
+	if !strings.HasPrefix(access.String(), "unix:"+path+" "+username+" ") {
+		t.Fatalf("bad: %q", access.String())
+	}
+	accessMu.Unlock()
+
+	// TCP clients have no peer credentials
+	if method := request("tcp", tcp.Addr().String()); method != noAcceptable {
+		t.Fatalf("bad: %v", method)
+	}
+}
+
+// lockedWriter serializes writes to w
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w lockedWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(b)
+}
@@ -0,0 +1,184 @@
+package socks5
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+)
+
+const (
+	// handshakeBufferSize buffers the negotiation, whose messages are
+	// a few hundred bytes at most
+	handshakeBufferSize = 512
+	// smallBufferSize is the buffer of a relay direction reading a
+	// source that cannot be waited on, see copyBuffer
+	smallBufferSize = 512
+	// relayBufferSize is the buffer a relay direction borrows once data
+	// has arrived
+	relayBufferSize = 32 << 10
+)
+
+var (
+	handshakeReaders = sync.Pool{
+		New: func() any { return bufio.NewReaderSize(nil, handshakeBufferSize) },
+	}
+	relayBuffers = sync.Pool{
+		New: func() any {
+			b := make([]byte, relayBufferSize)
+			return &b
+		},
+	}
+)
+
+// handshakeReader buffers the reads of the negotiation with a pooled
+// bufio.Reader. Once the session is relayed, drain passes on what is
+// left in the buffer and returns it to the pool; later reads go to the
+// connection directly.
+type handshakeReader struct {
+	conn io.Reader
+	buf  *bufio.Reader
+}
+
+func newHandshakeReader(conn io.Reader) *handshakeReader {
+	buf := handshakeReaders.Get().(*bufio.Reader)
+	buf.Reset(conn)
+	return &handshakeReader{conn: conn, buf: buf}
+}
+
+func (r *handshakeReader) Read(b []byte) (int, error) {
+	if r.buf == nil {
+		return r.conn.Read(b)
+	}
+	return r.buf.Read(b)
+}
+
+// drain writes the data the client sent along with its request to w and
+// releases the buffer
+func (r *handshakeReader) drain(w io.Writer) error {
+	if r.buf == nil {
+		return nil
+	}
+	if n := r.buf.Buffered(); n > 0 {
+		b, _ := r.buf.Peek(n)
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	r.release()
+	return nil
+}
+
+// detach returns conn, reading first what is left in the buffer, and
+// releases the buffer. r must not be read afterwards.
+func (r *handshakeReader) detach(conn net.Conn) net.Conn {
+	var rest []byte
+	if n := r.buf.Buffered(); n > 0 {
+		b, _ := r.buf.Peek(n)
+		rest = append(rest, b...)
+	}
+	r.release()
+	return &prefixConn{Conn: conn, prefix: rest}
+}
+
+// prefixConn is a net.Conn returning prefix before what it reads from
+// Conn
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// release returns the buffer to the pool, dropping what it still holds.
+// It is a no-op once released.
+func (r *handshakeReader) release() {
+	if r.buf == nil {
+		return
+	}
+	r.buf.Reset(nil)
+	handshakeReaders.Put(r.buf)
+	r.buf = nil
+}
+
+// copyBuffer copies src to dst until EOF like io.Copy, without holding
+// a large buffer while src has nothing to read, so idle sessions do not
+// pin one. When src reads a socket directly, copyBuffer waits for it to
+// have data before it borrows a relay buffer from the pool, and returns
+// the buffer as soon as it has been written. Other sources, such as TLS
+// connections, may hold data their socket does not show, and are read
+// through a small buffer instead.
+func copyBuffer(dst io.Writer, src io.Reader) (written int64, err error) {
+	sock := socketOf(src)
+	var small []byte
+	if sock == nil {
+		small = make([]byte, smallBufferSize)
+	}
+	for {
+		buf := small
+		var borrowed *[]byte
+		if sock != nil {
+			// errors of the socket are left for the read to report
+			waitReadable(sock)
+			borrowed = relayBuffers.Get().(*[]byte)
+			buf = *borrowed
+		}
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			var nw int
+			nw, err = dst.Write(buf[:nr])
+			written += int64(nw)
+			if err == nil && nw != nr {
+				err = io.ErrShortWrite
+			}
+		}
+		if borrowed != nil {
+			relayBuffers.Put(borrowed)
+		}
+		if err != nil {
+			return written, err
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// socketOf returns the socket src reads from, if it does so directly or
+// through the wrappers of a session that buffer nothing, and if
+// waitReadable can wait for it
+func socketOf(src io.Reader) syscall.Conn {
+	if !canWaitReadable {
+		return nil
+	}
+	for {
+		switch r := src.(type) {
+		case *activityReader:
+			src = r.Reader
+		case *handshakeReader:
+			if r.buf != nil {
+				return nil
+			}
+			src = r.conn
+		case *ConnWrapper:
+			src = r.Conn
+		case *net.TCPConn:
+			return r
+		case *net.UnixConn:
+			return r
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestHandshakeReader(t *testing.T) {
+	r := newHandshakeReader(strings.NewReader("request+data"))
+	head := make([]byte, 7)
+	if _, err := io.ReadFull(r, head); err != nil || string(head) != "request" {
+		t.Fatalf("bad: %q %v", head, err)
+	}
+	// the rest was read into the buffer along with the request
+	var target bytes.Buffer
+	if err := r.drain(&target); err != nil || target.String() != "+data" {
+		t.Fatalf("bad: %q %v", target.String(), err)
+	}
+	if r.buf != nil {
+		t.Fatalf("buffer not released")
+	}
+	r.release()
+	if rest, _ := io.ReadAll(r); len(rest) != 0 {
+		t.Fatalf("bad: %q", rest)
+	}
+
+	// reads go to the connection once drained
+	r = newHandshakeReader(iotest.OneByteReader(strings.NewReader("ab")))
+	r.Read(make([]byte, 1))
+	r.drain(io.Discard)
+	if rest, _ := io.ReadAll(r); string(rest) != "b" {
+		t.Fatalf("bad: %q", rest)
+	}
+}
+
+func TestCopyBuffer(t *testing.T) {
+	data := make([]byte, 3*relayBufferSize+smallBufferSize+1)
+	rand.Read(data)
+	for name, src := range map[string]func() io.Reader{
+		"bulk":  func() io.Reader { return bytes.NewReader(data) },
+		"half":  func() io.Reader { return iotest.HalfReader(bytes.NewReader(data)) },
+		"bytes": func() io.Reader { return iotest.OneByteReader(bytes.NewReader(data)) },
+		"eof":   func() io.Reader { return iotest.DataErrReader(bytes.NewReader(data)) },
+	} {
+		var dst bytes.Buffer
+		n, err := copyBuffer(&dst, src())
+		if err != nil || n != int64(len(data)) || !bytes.Equal(dst.Bytes(), data) {
+			t.Fatalf("%s: bad: %d %v", name, n, err)
+		}
+	}
+
+	// sockets are waited on before a relay buffer is borrowed
+	client, server := tcpPair(t)
+	defer server.Close()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	var dst bytes.Buffer
+	n, err := copyBuffer(&dst, &activityReader{Reader: server, last: new(int64)})
+	if err != nil || n != int64(len(data)) || !bytes.Equal(dst.Bytes(), data) {
+		t.Fatalf("socket: bad: %d %v", n, err)
+	}
+
+	if _, err := copyBuffer(shortWriter{}, bytes.NewReader(data)); err != io.ErrShortWrite {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := copyBuffer(io.Discard, iotest.TimeoutReader(bytes.NewReader(data))); err != iotest.ErrTimeout {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatalf("err: %v", err)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		tb.Fatalf("err: %v", err)
+	}
+	return dialed, accepted
+}
+
+func TestSocketOf(t *testing.T) {
+	if !canWaitReadable {
+		t.Skip("waitReadable does not wait on this system")
+	}
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	drained := newHandshakeReader(&ConnWrapper{Conn: server})
+	drained.release()
+	for _, c := range []struct {
+		name string
+		src  io.Reader
+		sock bool
+	}{
+		{"conn", server, true},
+		{"session", &activityReader{Reader: drained, last: new(int64)}, true},
+		{"handshake", newHandshakeReader(server), false},
+		{"wrapped", struct{ net.Conn }{server}, false},
+		{"reader", strings.NewReader(""), false},
+	} {
+		if sock := socketOf(c.src); (sock != nil) != c.sock {
+			t.Fatalf("%s: bad: %v", c.name, sock)
+		}
+	}
+}
+
+// shortWriter writes half of what it is given
+type shortWriter struct{}
+
+func (shortWriter) Write(b []byte) (int, error) {
+	return len(b) / 2, nil
+}
+
+// inUse returns the memory held by the heap and by goroutine stacks
+// after a collection, the second of which empties the pools
+func inUse() (heap, stack float64) {
+	runtime.GC()
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return float64(m.HeapInuse), float64(m.StackInuse)
+}
+
+// benchmarkSessionMemory opens sessions that stay idle after their
+// request, or if transfer is set after a chunk each way that fills the
+// buffers of a relay, and reports the memory they hold each, the client
+// and target ends included
+func benchmarkSessionMemory(b *testing.B, splice, transfer bool) {
+	const sessions = 2000
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	accepted := make(chan net.Conn, sessions)
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	serv, err := New(&Config{
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		AccessLogger: log.New(io.Discard, "", 0),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil || splice {
+				return conn, err
+			}
+			// hiding the TCPConn falls back to copying through buffers
+			return struct{ net.Conn }{conn}, nil
+		},
+	})
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	defer serv.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+
+	port := target.Addr().(*net.TCPAddr).Port
+	request := []byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)}
+	reply := make([]byte, 12)
+	chunk := make([]byte, smallBufferSize+relayBufferSize)
+	for i := 0; i < b.N; i++ {
+		heap, stack := inUse()
+		conns := make([]net.Conn, 0, 2*sessions)
+		for j := 0; j < sessions; j++ {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				b.Fatalf("err: %v", err)
+			}
+			conns = append(conns, conn)
+			conn.Write(request)
+			if _, err := io.ReadFull(conn, reply); err != nil || reply[3] != successReply {
+				b.Fatalf("bad: %v %v", reply, err)
+			}
+			accepted := <-accepted
+			conns = append(conns, accepted)
+			if transfer {
+				for _, pair := range [][2]net.Conn{{conn, accepted}, {accepted, conn}} {
+					if _, err := pair[0].Write(chunk); err != nil {
+						b.Fatalf("err: %v", err)
+					}
+					if _, err := io.ReadFull(pair[1], chunk); err != nil {
+						b.Fatalf("err: %v", err)
+					}
+				}
+			}
+		}
+		// let the relays settle into waiting for data
+		time.Sleep(100 * time.Millisecond)
+		heapAfter, stackAfter := inUse()
+		b.ReportMetric((heapAfter-heap)/sessions, "heap-B/session")
+		b.ReportMetric((stackAfter-stack)/sessions, "stack-B/session")
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+		for len(serv.Sessions()) > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// Measure with:
+//
+//	go test -run '^$' -bench SessionMemory -benchtime 3x
+func BenchmarkSessionMemory_Splice(b *testing.B) {
+	benchmarkSessionMemory(b, true, false)
+}
+
+func BenchmarkSessionMemory_Copy(b *testing.B) {
+	benchmarkSessionMemory(b, false, false)
+}
+
+func BenchmarkSessionMemory_CopyAfterTransfer(b *testing.B) {
+	benchmarkSessionMemory(b, false, true)
+}
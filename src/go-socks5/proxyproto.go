@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyV2Signature starts a PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// proxyV1MaxLen is the longest v1 header, CRLF included
+	proxyV1MaxLen = 107
+	// v2 commands, with the version in the high nibble
+	proxyV2Local = 0x20
+	proxyV2Proxy = 0x21
+	// v2 address families and transport protocols
+	proxyV2TCP4 = 0x11
+	proxyV2TCP6 = 0x21
+)
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header and returns the
+// source address it carries and its length. The address is nil for
+// connections the proxy makes on its own, e.g. health checks, and for
+// sources it does not know.
+func readProxyHeader(r *bufio.Reader) (*net.TCPAddr, int, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to read PROXY protocol header: %w", err)
+	}
+	switch {
+	case bytes.Equal(sig, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readProxyV1(r)
+	}
+	return nil, 0, fmt.Errorf("Missing PROXY protocol header")
+}
+
+// readProxyV1 reads a header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n"
+func readProxyV1(r *bufio.Reader) (*net.TCPAddr, int, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, 0, fmt.Errorf("Failed to read PROXY protocol header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	n := len(line)
+	header, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, n, fmt.Errorf("Invalid PROXY protocol v1 header")
+	}
+	fields := strings.Split(header, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, n, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, n, fmt.Errorf("Invalid PROXY protocol v1 header: %q", header)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, n, fmt.Errorf("Invalid PROXY protocol v1 source: %q", header)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, n, nil
+}
+
+// readProxyV2 reads a binary header. TLVs are skipped.
+func readProxyV2(r *bufio.Reader) (*net.TCPAddr, int, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, fmt.Errorf("Failed to read PROXY protocol header: %w", err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, 0, fmt.Errorf("Failed to read PROXY protocol header: %w", err)
+	}
+	n := len(header) + len(body)
+	switch header[12] {
+	case proxyV2Local:
+		return nil, n, nil
+	case proxyV2Proxy:
+	default:
+		return nil, n, fmt.Errorf("Unsupported PROXY protocol version or command: %#x", header[12])
+	}
+	var ipLen int
+	switch header[13] {
+	case proxyV2TCP4:
+		ipLen = net.IPv4len
+	case proxyV2TCP6:
+		ipLen = net.IPv6len
+	default:
+		// UDP, Unix sockets or unspecified
+		return nil, n, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, n, fmt.Errorf("Short PROXY protocol v2 address block")
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, body[:ipLen])
+	port := binary.BigEndian.Uint16(body[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, n, nil
+}
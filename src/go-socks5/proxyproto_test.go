@@ -0,0 +1,169 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a v2 header with command cmd from src to dst
+func proxyV2Header(cmd byte, src, dst *net.TCPAddr, tlvs []byte) []byte {
+	family := byte(proxyV2TCP4)
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil {
+		family = proxyV2TCP6
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	body := append(append([]byte{}, srcIP...), dstIP...)
+	body = binary.BigEndian.AppendUint16(body, uint16(src.Port))
+	body = binary.BigEndian.AppendUint16(body, uint16(dst.Port))
+	body = append(body, tlvs...)
+	header := append(append([]byte{}, proxyV2Signature...), cmd, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return append(header, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 56324}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 1080}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1080}
+	for _, c := range []struct {
+		name   string
+		header string
+		source string
+		err    bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n", "192.0.2.1:56324", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 443 1080\r\n", "[2001:db8::1]:443", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::1 2001:db8::2 443 1080\r\n", "", true},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 65536 1080\r\n", "", true},
+		{"v1 no CRLF", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\n", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", true},
+		{"v2 tcp4", string(proxyV2Header(proxyV2Proxy, v4, dst, []byte{0x04, 0, 1, 'x'})), "192.0.2.1:56324", false},
+		{"v2 tcp6", string(proxyV2Header(proxyV2Proxy, v6, dst6, nil)), "[2001:db8::1]:443", false},
+		{"v2 local", string(proxyV2Header(proxyV2Local, v4, dst, nil)), "", false},
+		{"v2 bad command", string(proxyV2Header(0x22, v4, dst, nil)), "", true},
+		{"v2 truncated", string(proxyV2Header(proxyV2Proxy, v4, dst, nil)[:20]), "", true},
+		{"missing", "\x05\x01\x00\x05\x01\x00\x01\x7f\x00\x00\x01\x00\x50", "", true},
+	} {
+		r := bufio.NewReader(strings.NewReader(c.header + "rest"))
+		source, n, err := readProxyHeader(r)
+		if (err != nil) != c.err {
+			t.Fatalf("%s: err: %v", c.name, err)
+		}
+		if c.err {
+			continue
+		}
+		if n != len(c.header) {
+			t.Fatalf("%s: bad length %d", c.name, n)
+		}
+		if (source == nil && c.source != "") || (source != nil && source.String() != c.source) {
+			t.Fatalf("%s: bad source %v", c.name, source)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+			t.Fatalf("%s: bad rest %q", c.name, rest)
+		}
+	}
+}
+
+func TestServer_ProxyProtocol(t *testing.T) {
+	rules := &recordingRules{}
+	var access bytes.Buffer
+	var accessMu sync.Mutex
+	serv := newTestServer(t, &Config{
+		Rules:        rules,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		AccessLogger: log.New(lockedWriter{&accessMu, &access}, "", 0),
+	})
+	addr := serveListener(t, serv, &ListenerConfig{
+		TrustProxy: func(addr net.Addr) bool {
+			return addr.(*net.TCPAddr).IP.IsLoopback()
+		},
+		AllowClient: func(addr net.Addr) bool {
+			return !addr.(*net.TCPAddr).IP.Equal(net.ParseIP("203.0.113.9"))
+		},
+	})
+
+	request := func(header string) []byte {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte(header))
+		conn.Write([]byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+		out, _ := io.ReadAll(conn)
+		return out
+	}
+
+	if out := request("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n"); len(out) < 4 || out[3] != ruleFailure {
+		t.Fatalf("bad: %v", out)
+	}
+	if client := rules.last().remote; client != "192.0.2.1:56324" {
+		t.Fatalf("bad: %q", client)
+	}
+	// the header is not counted as client traffic
+	accessMu.Lock()
+	if fields := strings.Split(access.String(), " "); len(fields) < 6 || fields[0] != "192.0.2.1:56324" || fields[4] != "13" {
+		t.Fatalf("bad: %q", access.String())
+	}
+	accessMu.Unlock()
+
+	// the allowlist applies to the real client
+	if out := request("PROXY TCP4 203.0.113.9 198.51.100.1 56324 1080\r\n"); len(out) != 0 {
+		t.Fatalf("bad: %v", out)
+	}
+	// a trusted source must send the header
+	if out := request(""); len(out) != 0 {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestServer_ProxyProtocol_TLS(t *testing.T) {
+	ca := newTestCA(t)
+	rules := &recordingRules{}
+	serv := newTestServer(t, &Config{
+		Rules:  rules,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	addr := serveListener(t, serv, &ListenerConfig{
+		TrustProxy: func(addr net.Addr) bool {
+			return addr.(*net.TCPAddr).IP.IsLoopback()
+		},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.issue(t, "proxy", 2, "proxy.example")},
+		},
+	})
+
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(time.Second))
+	// the header comes in the clear, before the TLS handshake
+	raw.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n"))
+	conn := tls.Client(raw, &tls.Config{RootCAs: ca.pool, ServerName: "proxy.example"})
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Write([]byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	if out, _ := io.ReadAll(conn); len(out) < 4 || out[3] != ruleFailure {
+		t.Fatalf("bad: %v", out)
+	}
+	if client := rules.last().remote; client != "192.0.2.1:56324" {
+		t.Fatalf("bad: %q", client)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -33,9 +35,13 @@ const (
 
 var (
 	unrecognizedAddrType = fmt.Errorf("Unrecognized address type")
+	ErrIdleTimeout       = fmt.Errorf("Idle timeout")
+	ErrSessionExpired    = fmt.Errorf("Session lifetime exceeded")
 )
 
-// AddressRewriter is used to rewrite a destination transparently
+// AddressRewriter is used to rewrite a destination transparently.
+// A FQDN destination is passed before it is resolved, with no IP, and
+// once more with the address it resolved to if it was left alone.
 type AddressRewriter interface {
 	Rewrite(ctx context.Context, request *Request) (context.Context, *AddrSpec)
 }
@@ -49,10 +55,12 @@ type AddrSpec struct {
 }
 
 func (a *AddrSpec) String() string {
-	if a.FQDN != "" {
+	if a.FQDN != "" && a.IP != nil {
 		return fmt.Sprintf("%s (%s):%d", a.FQDN, a.IP, a.Port)
 	}
-	return fmt.Sprintf("%s:%d", a.IP, a.Port)
+	// an address, or a name that was not resolved, e.g. because it
+	// was rewritten
+	return a.Address()
 }
 
 // Address returns a string suitable to dial; prefer returning IP-based
@@ -76,9 +84,12 @@ type Request struct {
 	RemoteAddr *AddrSpec
 	// AddrSpec of the desired destination
 	DestAddr *AddrSpec
-	// AddrSpec of the actual destination (might be affected by rewrite)
+	// AddrSpec of the actual destination (might be affected by rewrite),
+	// see RealDestAddr
 	realDestAddr *AddrSpec
-	bufConn      io.Reader
+	// every address the FQDN of DestAddr resolved to
+	destIPs []net.IP
+	bufConn io.Reader
 }
 
 type conn interface {
@@ -90,7 +101,7 @@ type conn interface {
 func NewRequest(bufConn io.Reader) (*Request, error) {
 	// Read the version byte
 	header := []byte{0, 0, 0}
-	if _, err := io.ReadAtLeast(bufConn, header, 3); err != nil {
+	if _, err := io.ReadFull(bufConn, header); err != nil {
 		return nil, fmt.Errorf("Failed to get command version: %v", err)
 	}
 
@@ -115,14 +126,67 @@ func NewRequest(bufConn io.Reader) (*Request, error) {
 	return request, nil
 }
 
+// RealDestAddr returns the address the request connects to: DestAddr,
+// or the address a Rewriter replaced it with. It is nil before the
+// destination is resolved and rewritten, e.g. in NameRuleSet.AllowName.
+func (r *Request) RealDestAddr() *AddrSpec {
+	return r.realDestAddr
+}
+
+// Rewritten reports whether a Rewriter changed the destination
+func (r *Request) Rewritten() bool {
+	return r.realDestAddr != nil && r.realDestAddr != r.DestAddr
+}
+
+// destString describes the destination for errors, with the rewritten
+// address if any
+func (r *Request) destString() string {
+	if r.Rewritten() {
+		return fmt.Sprintf("%v (rewritten to %v)", r.DestAddr, r.realDestAddr.Address())
+	}
+	return r.DestAddr.String()
+}
+
 // handleRequest is used for request processing after authentication
-func (s *Server) handleRequest(req *Request, conn conn) error {
-	ctx := context.Background()
+func (s *Server) handleRequest(ctx context.Context, req *Request, conn conn) error {
+	ctx = withRequest(ctx, req)
+	// Check the requested destination before it is looked up
+	if rules, ok := s.rules(ctx).(NameRuleSet); ok {
+		ctx_, ok := rules.AllowName(ctx, req)
+		if !ok {
+			if err := sendReply(conn, ruleFailure, nil); err != nil {
+				return fmt.Errorf("Failed to send reply: %v", err)
+			}
+			return fmt.Errorf("Request to %v blocked by rules", req.DestAddr)
+		}
+		ctx = ctx_
+	}
+
+	// Apply any address rewrites. A name is rewritten before it is
+	// resolved, so only the destination connected to is looked up.
+	req.realDestAddr = req.DestAddr
+	if s.config.Rewriter != nil {
+		ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
+	}
 
 	// Resolve the address if we have a FQDN
 	dest := req.DestAddr
-	if dest.FQDN != "" {
-		ctx_, addr, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
+	if dest.FQDN != "" && !req.Rewritten() {
+		var ctx_ context.Context
+		var addr net.IP
+		var err error
+		if resolver, ok := s.config.Resolver.(MultiResolver); ok {
+			ctx_, req.destIPs, err = resolver.ResolveAll(ctx, dest.FQDN)
+			if err == nil && len(req.destIPs) == 0 {
+				err = fmt.Errorf("no addresses")
+			}
+			if err == nil {
+				req.destIPs = interleaveFamilies(req.destIPs)
+				addr = req.destIPs[0]
+			}
+		} else {
+			ctx_, addr, err = s.config.Resolver.Resolve(ctx, dest.FQDN)
+		}
 		if err != nil {
 			if err := sendReply(conn, hostUnreachable, nil); err != nil {
 				return fmt.Errorf("Failed to send reply: %v", err)
@@ -131,12 +195,26 @@ func (s *Server) handleRequest(req *Request, conn conn) error {
 		}
 		ctx = ctx_
 		dest.IP = addr
+		// rewrites by address apply to the one the name resolved to
+		if s.config.Rewriter != nil {
+			ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
+		}
 	}
 
-	// Apply any address rewrites
-	req.realDestAddr = req.DestAddr
-	if s.config.Rewriter != nil {
-		ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
+	// a rewritten name is resolved here so the rules see the address
+	// connected to
+	if req.Rewritten() && req.realDestAddr.IP == nil && req.realDestAddr.FQDN != "" {
+		real := *req.realDestAddr
+		ctx_, addr, err := s.config.Resolver.Resolve(ctx, real.FQDN)
+		if err != nil {
+			if err := sendReply(conn, hostUnreachable, nil); err != nil {
+				return fmt.Errorf("Failed to send reply: %v", err)
+			}
+			return fmt.Errorf("Failed to resolve rewritten destination '%v': %v", real.FQDN, err)
+		}
+		ctx = ctx_
+		real.IP = addr
+		req.realDestAddr = &real
 	}
 
 	// Switch on the command
@@ -155,26 +233,81 @@ func (s *Server) handleRequest(req *Request, conn conn) error {
 	}
 }
 
+// allowedCandidates returns the addresses a CONNECT may try, checking
+// each address the FQDN resolved to against the rules
+func (s *Server) allowedCandidates(ctx context.Context, req *Request) (context.Context, []net.IP) {
+	// a rewritten destination is dialed as is
+	if len(req.destIPs) <= 1 || req.Rewritten() {
+		ctx_, ok := s.rules(ctx).Allow(ctx, req)
+		if !ok {
+			return ctx, nil
+		}
+		return ctx_, []net.IP{req.DestAddr.IP}
+	}
+	var allowedCtx context.Context
+	var allowed []net.IP
+	for _, ip := range req.destIPs {
+		candidate := *req
+		dest := *req.DestAddr
+		dest.IP = ip
+		candidate.DestAddr, candidate.realDestAddr = &dest, &dest
+		if ctx_, ok := s.rules(ctx).Allow(ctx, &candidate); ok {
+			if allowedCtx == nil {
+				allowedCtx = ctx_
+			}
+			allowed = append(allowed, ip)
+		} else {
+			Logger(ctx).Debug("address blocked by rules", "addr", ip.String())
+		}
+	}
+	if allowedCtx == nil {
+		return ctx, nil
+	}
+	req.DestAddr.IP = allowed[0]
+	return allowedCtx, allowed
+}
+
 // handleConnect is used to handle a connect command
 func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
+	ctx, candidates := s.allowedCandidates(ctx, req)
+	if len(candidates) == 0 {
 		if err := sendReply(conn, ruleFailure, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
-		return fmt.Errorf("Connect to %v blocked by rules", req.DestAddr)
-	} else {
-		ctx = ctx_
+		return fmt.Errorf("Connect to %v blocked by rules", req.destString())
 	}
 
 	// Attempt to connect
 	dial := s.config.Dial
 	if dial == nil {
-		dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
-			return net.Dial(net_, addr)
+		var dialer net.Dialer
+		dial = dialer.DialContext
+		// Without IPv4 connectivity, IPv4 addresses are reached through
+		// NAT64, as names are by the addresses HostsResolver synthesizes
+		if prefix := s.config.NAT64Prefix; prefix != nil {
+			dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, NAT64Address(prefix, addr))
+			}
+		}
+	}
+	var target net.Conn
+	var err error
+	if len(candidates) == 1 {
+		target, err = dial(ctx, "tcp", req.realDestAddr.Address())
+	} else {
+		addrs := make([]string, len(candidates))
+		for i, ip := range candidates {
+			addrs[i] = net.JoinHostPort(ip.String(), strconv.Itoa(req.DestAddr.Port))
+		}
+		var addr string
+		target, addr, err = s.dialHappyEyeballs(ctx, dial, addrs)
+		if err == nil {
+			// report the address actually connected to
+			host, _, _ := net.SplitHostPort(addr)
+			req.DestAddr.IP = net.ParseIP(host)
 		}
 	}
-	target, err := dial(ctx, "tcp", req.realDestAddr.Address())
 	if err != nil {
 		msg := err.Error()
 		resp := hostUnreachable
@@ -186,7 +319,7 @@ func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) err
 		if err := sendReply(conn, resp, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
-		return fmt.Errorf("Connect to %v failed: %v", req.DestAddr, err)
+		return fmt.Errorf("Connect to %v failed: %v", req.destString(), err)
 	}
 	defer target.Close()
 
@@ -198,16 +331,74 @@ func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) err
 	}
 
 	// Start proxying
+	return s.relay(ctx, conn, req.bufConn, target)
+}
+
+// relay shuffles data between the client and the target until both
+// directions are done, ctx is cancelled, or the idle timeout or session
+// lifetime expires. Between TCP connections the data bypasses
+// the buffers, see tcpRelay; otherwise it goes through pooled ones, see
+// copyBuffer.
+func (s *Server) relay(ctx context.Context, conn io.Writer, bufConn io.Reader, target net.Conn) error {
+	var src, dst io.Reader = bufConn, target
+	var lastActive int64
+	var idleTimer *time.Timer
+	var idle, lifetime <-chan time.Time
+	if s.config.IdleTimeout > 0 {
+		lastActive = time.Now().UnixNano()
+		src = &activityReader{Reader: src, last: &lastActive}
+		dst = &activityReader{Reader: dst, last: &lastActive}
+		idleTimer = time.NewTimer(s.config.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	if s.config.MaxSessionDuration > 0 {
+		lifetimeTimer := time.NewTimer(s.config.MaxSessionDuration)
+		defer lifetimeTimer.Stop()
+		lifetime = lifetimeTimer.C
+	}
+
+	// Pass on what the client sent along with its request; this frees
+	// the handshake buffer for the rest of the session
+	if hs, ok := bufConn.(*handshakeReader); ok {
+		if err := hs.drain(target); err != nil {
+			return err
+		}
+	}
+
 	errCh := make(chan error, 2)
-	go proxy(target, req.bufConn, errCh)
-	go proxy(conn, target, errCh)
-
-	// Wait
-	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			// return from this function closes target (and conn).
-			return e
+	if tcp, ok := newTCPRelay(conn, bufConn, target); ok {
+		var last *int64
+		interval := spliceInterval
+		if s.config.IdleTimeout > 0 {
+			last = &lastActive
+			interval = min(interval, s.config.IdleTimeout/2)
+		}
+		tcp.start(errCh, last, interval)
+	} else {
+		go proxy(target, src, errCh)
+		go proxy(conn, dst, errCh)
+	}
+
+	// Wait; returning from this function closes target (and conn).
+	for done := 0; done < 2; {
+		select {
+		case e := <-errCh:
+			if e != nil {
+				return e
+			}
+			done++
+		case <-idle:
+			since := time.Since(time.Unix(0, atomic.LoadInt64(&lastActive)))
+			if since < s.config.IdleTimeout {
+				idleTimer.Reset(s.config.IdleTimeout - since)
+				continue
+			}
+			return ErrIdleTimeout
+		case <-lifetime:
+			return ErrSessionExpired
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 	return nil
@@ -216,11 +407,11 @@ func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) err
 // handleBind is used to handle a connect command
 func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
+	if ctx_, ok := s.rules(ctx).Allow(ctx, req); !ok {
 		if err := sendReply(conn, ruleFailure, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
-		return fmt.Errorf("Bind to %v blocked by rules", req.DestAddr)
+		return fmt.Errorf("Bind to %v blocked by rules", req.destString())
 	} else {
 		ctx = ctx_
 	}
@@ -235,11 +426,11 @@ func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error
 // handleAssociate is used to handle a connect command
 func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
+	if ctx_, ok := s.rules(ctx).Allow(ctx, req); !ok {
 		if err := sendReply(conn, ruleFailure, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
-		return fmt.Errorf("Associate to %v blocked by rules", req.DestAddr)
+		return fmt.Errorf("Associate to %v blocked by rules", req.destString())
 	} else {
 		ctx = ctx_
 	}
@@ -258,7 +449,7 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 
 	// Get the address type
 	addrType := []byte{0}
-	if _, err := r.Read(addrType); err != nil {
+	if _, err := io.ReadFull(r, addrType); err != nil {
 		return nil, err
 	}
 
@@ -266,25 +457,28 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 	switch addrType[0] {
 	case ipv4Address:
 		addr := make([]byte, 4)
-		if _, err := io.ReadAtLeast(r, addr, len(addr)); err != nil {
+		if _, err := io.ReadFull(r, addr); err != nil {
 			return nil, err
 		}
 		d.IP = net.IP(addr)
 
 	case ipv6Address:
 		addr := make([]byte, 16)
-		if _, err := io.ReadAtLeast(r, addr, len(addr)); err != nil {
+		if _, err := io.ReadFull(r, addr); err != nil {
 			return nil, err
 		}
 		d.IP = net.IP(addr)
 
 	case fqdnAddress:
-		if _, err := r.Read(addrType); err != nil {
+		if _, err := io.ReadFull(r, addrType); err != nil {
 			return nil, err
 		}
 		addrLen := int(addrType[0])
+		if addrLen == 0 {
+			return nil, fmt.Errorf("Empty FQDN")
+		}
 		fqdn := make([]byte, addrLen)
-		if _, err := io.ReadAtLeast(r, fqdn, addrLen); err != nil {
+		if _, err := io.ReadFull(r, fqdn); err != nil {
 			return nil, err
 		}
 		d.FQDN = string(fqdn)
@@ -295,7 +489,7 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 
 	// Read the port
 	port := []byte{0, 0}
-	if _, err := io.ReadAtLeast(r, port, 2); err != nil {
+	if _, err := io.ReadFull(r, port); err != nil {
 		return nil, err
 	}
 	d.Port = (int(port[0]) << 8) | int(port[1])
@@ -349,6 +543,21 @@ func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
 	return err
 }
 
+// activityReader records the time of the last successful read, so that
+// relay can tell when a session has gone idle
+type activityReader struct {
+	io.Reader
+	last *int64
+}
+
+func (r *activityReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(r.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
 type closeWriter interface {
 	CloseWrite() error
 }
@@ -356,7 +565,7 @@ type closeWriter interface {
 // proxy is used to suffle data from src to destination, and sends errors
 // down a dedicated channel
 func proxy(dst io.Writer, src io.Reader, errCh chan error) {
-	_, err := io.Copy(dst, src)
+	_, err := copyBuffer(dst, src)
 	if tcpConn, ok := dst.(closeWriter); ok {
 		tcpConn.CloseWrite()
 	}
@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 type MockConn struct {
@@ -32,17 +35,20 @@ func TestRequest_Connect(t *testing.T) {
 	go func() {
 		conn, err := l.Accept()
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
 		buf := make([]byte, 4)
 		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 
 		if !bytes.Equal(buf, []byte("ping")) {
-			t.Fatalf("bad: %v", buf)
+			t.Errorf("bad: %v", buf)
+			return
 		}
 		conn.Write([]byte("pong"))
 	}()
@@ -52,7 +58,7 @@ func TestRequest_Connect(t *testing.T) {
 	s := &Server{config: &Config{
 		Rules:    PermitAll(),
 		Resolver: DNSResolver{},
-		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		Logger:   slog.New(slog.NewTextHandler(os.Stdout, nil)),
 	}}
 
 	// Create the connect request
@@ -73,7 +79,7 @@ func TestRequest_Connect(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := s.handleRequest(req, resp); err != nil {
+	if err := s.handleRequest(context.Background(), req, resp); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -107,17 +113,20 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 	go func() {
 		conn, err := l.Accept()
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
 		buf := make([]byte, 4)
 		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 
 		if !bytes.Equal(buf, []byte("ping")) {
-			t.Fatalf("bad: %v", buf)
+			t.Errorf("bad: %v", buf)
+			return
 		}
 		conn.Write([]byte("pong"))
 	}()
@@ -127,7 +136,7 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 	s := &Server{config: &Config{
 		Rules:    PermitNone(),
 		Resolver: DNSResolver{},
-		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		Logger:   slog.New(slog.NewTextHandler(os.Stdout, nil)),
 	}}
 
 	// Create the connect request
@@ -148,7 +157,7 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 
-	if err := s.handleRequest(req, resp); !strings.Contains(err.Error(), "blocked by rules") {
+	if err := s.handleRequest(context.Background(), req, resp); !strings.Contains(err.Error(), "blocked by rules") {
 		t.Fatalf("err: %v", err)
 	}
 
@@ -167,3 +176,132 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 		t.Fatalf("bad: %v %v", out, expected)
 	}
 }
+
+func TestRequest_Connect_IdleTimeout(t *testing.T) {
+	// Create a local listener that accepts but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		<-stop
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// Make server
+	s := &Server{config: &Config{
+		Rules:       PermitAll(),
+		Resolver:    DNSResolver{},
+		Logger:      slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		IdleTimeout: 50 * time.Millisecond,
+	}}
+
+	// Create the connect request
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+	buf.Write(port)
+
+	// Handle the request
+	resp := &MockConn{}
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := s.handleRequest(context.Background(), req, resp); err != ErrIdleTimeout {
+		t.Fatalf("err: %v", err)
+	}
+	if reason := closeReason(ErrIdleTimeout); reason != "idle-timeout" {
+		t.Fatalf("bad: %v", reason)
+	}
+}
+
+func TestRequest_Connect_SessionExpired(t *testing.T) {
+	// Create a local listener that keeps the session busy
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// Make server
+	s := &Server{config: &Config{
+		Rules:              PermitAll(),
+		Resolver:           DNSResolver{},
+		Logger:             slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		IdleTimeout:        50 * time.Millisecond,
+		MaxSessionDuration: 200 * time.Millisecond,
+	}}
+
+	// Create the connect request
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+	buf.Write(port)
+
+	// Handle the request
+	resp := &MockConn{}
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := s.handleRequest(context.Background(), req, resp); err != ErrSessionExpired {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func FuzzNewRequest(f *testing.F) {
+	f.Add([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{5, 1, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 187})
+	f.Add([]byte{5, 1, 0, 3, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0, 80})
+	f.Add([]byte{5, 1, 0, 3, 0, 0, 80})
+	f.Add([]byte{5, 1, 0, 3, 255, 'a'})
+	f.Add([]byte{5, 1, 0, 2, 0, 0})
+	f.Add([]byte{4, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{5, 1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := NewRequest(bytes.NewReader(data))
+		if err != nil {
+			if req != nil {
+				t.Fatalf("request on error: %v", req)
+			}
+			return
+		}
+		dest := req.DestAddr
+		if dest.FQDN == "" && len(dest.IP) != net.IPv4len && len(dest.IP) != net.IPv6len {
+			t.Fatalf("bad address: %v", dest)
+		}
+		if dest.Port < 0 || dest.Port > 65535 {
+			t.Fatalf("bad port: %v", dest.Port)
+		}
+	})
+}
@@ -11,6 +11,13 @@ type NameResolver interface {
 	Resolve(ctx context.Context, name string) (context.Context, net.IP, error)
 }
 
+// MultiResolver can be implemented by a NameResolver to return every
+// address of a name, so a CONNECT can fall back to the others when one
+// is unreachable
+type MultiResolver interface {
+	ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error)
+}
+
 // DNSResolver uses the system DNS to resolve host names
 type DNSResolver struct{}
 
@@ -21,3 +28,16 @@ func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context,
 	}
 	return ctx, addr.IP, err
 }
+
+// ResolveAll returns the A and AAAA records of name
+func (d DNSResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ctx, ips, nil
+}
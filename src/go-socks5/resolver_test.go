@@ -19,3 +19,21 @@ func TestDNSResolver(t *testing.T) {
 		t.Fatalf("expected loopback")
 	}
 }
+
+func TestDNSResolver_ResolveAll(t *testing.T) {
+	d := DNSResolver{}
+	ctx := context.Background()
+
+	_, addrs, err := d.ResolveAll(ctx, "localhost")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(addrs) == 0 {
+		t.Fatalf("expected addresses")
+	}
+	for _, addr := range addrs {
+		if !addr.IsLoopback() {
+			t.Fatalf("expected loopback, got %v", addr)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// RewriteRule sends the destinations matching a network or a domain, and
+// optionally a port, to another address
+type RewriteRule struct {
+	// Network matches the destination IP, Domain the requested name and
+	// its subdomains; one of them is set
+	Network *net.IPNet
+	Domain  string
+	// Port restricts the rule to one destination port, if non-zero
+	Port int
+	// Target is the address to connect to instead; an empty IP and FQDN
+	// keep the destination's, and a zero port keeps its port
+	Target AddrSpec
+}
+
+// ParseRewriteRule parses a rule such as "91.108.4.0/22:443",
+// "[2001:db8::/32]", "*.example.org" or ":25" and its target, such as
+// "127.0.0.1:8443", "cache.local" or ":2525"
+func ParseRewriteRule(match, target string) (RewriteRule, error) {
+	var rule RewriteRule
+	host, port, err := splitOptionalPort(match)
+	if err != nil {
+		return rule, fmt.Errorf("Invalid rewrite match %q: %v", match, err)
+	}
+	rule.Port = port
+	if ip := net.ParseIP(host); ip != nil {
+		// a single address
+		if ip.To4() != nil {
+			host += "/32"
+		} else {
+			host += "/128"
+		}
+	}
+	if _, network, err := net.ParseCIDR(host); err == nil {
+		rule.Network = network
+	} else if host != "" {
+		rule.Domain = strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(host), "*."), ".")
+	} else if port == 0 {
+		return rule, fmt.Errorf("Invalid rewrite match %q: missing address or port", match)
+	}
+
+	host, port, err = splitOptionalPort(target)
+	if err != nil {
+		return rule, fmt.Errorf("Invalid rewrite target %q: %v", target, err)
+	}
+	rule.Target.Port = port
+	if ip := net.ParseIP(host); ip != nil {
+		rule.Target.IP = ip
+	} else {
+		rule.Target.FQDN = host
+	}
+	if host == "" && port == 0 {
+		return rule, fmt.Errorf("Invalid rewrite target %q: missing address or port", target)
+	}
+	return rule, nil
+}
+
+// splitOptionalPort splits "host", "host:port", "[host]:port" and ":port"
+func splitOptionalPort(s string) (string, int, error) {
+	if strings.HasPrefix(s, "[") {
+		host, rest, ok := strings.Cut(s[1:], "]")
+		if !ok {
+			return "", 0, fmt.Errorf("missing ']'")
+		}
+		if rest == "" {
+			return host, 0, nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", 0, fmt.Errorf("unexpected %q after ']'", rest)
+		}
+		port, err := parsePort(rest[1:])
+		return host, port, err
+	}
+	if strings.Count(s, ":") != 1 {
+		// no port, or a bare IPv6 address
+		return s, 0, nil
+	}
+	host, portStr, _ := strings.Cut(s, ":")
+	port, err := parsePort(portStr)
+	return host, port, err
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+func (r *RewriteRule) match(dest *AddrSpec) bool {
+	if r.Port != 0 && dest.Port != r.Port {
+		return false
+	}
+	if r.Network != nil {
+		return dest.IP != nil && r.Network.Contains(dest.IP)
+	}
+	if r.Domain != "" {
+		fqdn := strings.TrimSuffix(strings.ToLower(dest.FQDN), ".")
+		return fqdn != "" && (fqdn == r.Domain || strings.HasSuffix(fqdn, "."+r.Domain))
+	}
+	return true
+}
+
+// RuleRewriter is an AddressRewriter that redirects a destination by the
+// first of its rules that matches. Rules can be replaced while the
+// server runs. Rules for domains and ports apply before a name is
+// resolved, so a name they redirect is never looked up; rules for
+// networks apply to the address it resolves to.
+type RuleRewriter struct {
+	mu    sync.RWMutex
+	rules []RewriteRule
+}
+
+// SetRules replaces the rules
+func (r *RuleRewriter) SetRules(rules []RewriteRule) {
+	r.mu.Lock()
+	r.rules = rules
+	r.mu.Unlock()
+}
+
+// Rewrite implements the AddressRewriter interface. It returns
+// request.DestAddr itself when no rule matches.
+func (r *RuleRewriter) Rewrite(ctx context.Context, request *Request) (context.Context, *AddrSpec) {
+	r.mu.RLock()
+	rules := r.rules
+	r.mu.RUnlock()
+	dest := request.DestAddr
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.match(dest) {
+			continue
+		}
+		target := &AddrSpec{FQDN: dest.FQDN, IP: dest.IP, Port: dest.Port}
+		if rule.Target.IP != nil {
+			target.FQDN, target.IP = "", rule.Target.IP
+		} else if rule.Target.FQDN != "" {
+			target.FQDN, target.IP = rule.Target.FQDN, nil
+		}
+		if rule.Target.Port != 0 {
+			target.Port = rule.Target.Port
+		}
+		Logger(ctx).Info("destination rewritten", "target", target.Address())
+		return ctx, target
+	}
+	return ctx, dest
+}
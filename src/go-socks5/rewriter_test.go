@@ -0,0 +1,167 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseRewriteRule(t *testing.T) {
+	for _, c := range []struct {
+		match, target string
+		expected      string
+	}{
+		{"91.108.4.0/22:443", "127.0.0.1:8443", "net=91.108.4.0/22 port=443 -> 127.0.0.1:8443"},
+		{"149.154.167.51", "cache.local", "net=149.154.167.51/32 port=0 -> cache.local:0"},
+		{"[2001:db8::/32]:443", "[::1]:8443", "net=2001:db8::/32 port=443 -> [::1]:8443"},
+		{"2001:db8::1", ":8443", "net=2001:db8::1/128 port=0 -> :8443"},
+		{"*.Example.org", "127.0.0.1", "domain=example.org port=0 -> 127.0.0.1:0"},
+		{":25", ":2525", "domain= port=25 -> :2525"},
+	} {
+		rule, err := ParseRewriteRule(c.match, c.target)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var out string
+		if rule.Network != nil {
+			out = "net=" + rule.Network.String()
+		} else {
+			out = "domain=" + rule.Domain
+		}
+		out += " port=" + strconv.Itoa(rule.Port) + " -> " + rule.Target.Address()
+		if out != c.expected {
+			t.Fatalf("bad: %s=%s: %s", c.match, c.target, out)
+		}
+	}
+
+	for _, c := range [][2]string{
+		{"example.org:http", "127.0.0.1"},
+		{"[2001:db8::1", "127.0.0.1"},
+		{"example.org", ""},
+		{"", "127.0.0.1"},
+		{"example.org", "127.0.0.1:0"},
+	} {
+		if _, err := ParseRewriteRule(c[0], c[1]); err == nil {
+			t.Fatalf("expected error for %s=%s", c[0], c[1])
+		}
+	}
+}
+
+func TestRuleRewriter(t *testing.T) {
+	var rules []RewriteRule
+	for _, pair := range [][2]string{
+		{"192.0.2.0/24:443", "127.0.0.1:8443"},
+		{"cache.example.org", "cache.local"},
+		{":25", ":2525"},
+	} {
+		rule, err := ParseRewriteRule(pair[0], pair[1])
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		rules = append(rules, rule)
+	}
+	r := &RuleRewriter{}
+	r.SetRules(rules)
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		dest     AddrSpec
+		expected string
+	}{
+		{AddrSpec{IP: net.ParseIP("192.0.2.1"), Port: 443}, "127.0.0.1:8443"},
+		{AddrSpec{FQDN: "www.example.org", IP: net.ParseIP("192.0.2.1"), Port: 443}, "127.0.0.1:8443"},
+		{AddrSpec{IP: net.ParseIP("192.0.2.1"), Port: 80}, ""},
+		{AddrSpec{FQDN: "a.cache.example.org", IP: net.ParseIP("198.51.100.1"), Port: 80}, "cache.local:80"},
+		{AddrSpec{FQDN: "mail.example.org", IP: net.ParseIP("198.51.100.2"), Port: 25}, "198.51.100.2:2525"},
+	} {
+		req := &Request{Command: ConnectCommand, DestAddr: &c.dest}
+		_, target := r.Rewrite(ctx, req)
+		if c.expected == "" {
+			if target != req.DestAddr {
+				t.Fatalf("bad: %v rewritten to %v", c.dest, target)
+			}
+			continue
+		}
+		if target == req.DestAddr || target.Address() != c.expected {
+			t.Fatalf("bad: %v rewritten to %v", c.dest, target)
+		}
+	}
+}
+
+func TestRequest_Connect_Rewrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("pong"))
+	}()
+
+	rule, err := ParseRewriteRule("192.0.2.1:443", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	rewriter := &RuleRewriter{}
+	rewriter.SetRules([]RewriteRule{rule})
+	accessLog := bytes.NewBuffer(nil)
+	s, err := New(&Config{
+		Rules:        PermitAll(),
+		Rewriter:     rewriter,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		AccessLogger: log.New(accessLog, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer proxy.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := proxy.Accept()
+		if err != nil {
+			return
+		}
+		s.ServeConn(conn)
+	}()
+
+	client, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req := []byte{5, 1, 0, 5, 1, 0, 1, 192, 0, 2, 1, 0, 0}
+	binary.BigEndian.PutUint16(req[len(req)-2:], 443)
+	client.Write(req)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	out, _ := io.ReadAll(client)
+	client.Close()
+	<-done
+
+	// method selection, then the reply
+	if len(out) < 6 || out[3] != successReply || !bytes.HasSuffix(out, []byte("pong")) {
+		t.Fatalf("bad: %v", out)
+	}
+	line := strings.TrimSpace(accessLog.String())
+	if !strings.Contains(line, " 192.0.2.1:443 ") || !strings.HasSuffix(line, " "+l.Addr().String()) {
+		t.Fatalf("bad: %q", line)
+	}
+}
@@ -4,11 +4,27 @@ import (
 	"golang.org/x/net/context"
 )
 
-// RuleSet is used to provide custom rules to allow or prohibit actions
+// RuleSet is used to provide custom rules to allow or prohibit actions.
+//
+// Requests are checked in two phases. If the RuleSet also implements
+// NameRuleSet, AllowName first sees the destination as requested, before
+// its name is resolved. Allow is then called once the destination is
+// resolved and rewritten: req.DestAddr is the requested destination and
+// req.RealDestAddr() the address that will be connected to, so address
+// checks should use the latter. When a name resolves to several
+// addresses and is not rewritten, Allow is called for each of them and
+// only the allowed ones are tried.
 type RuleSet interface {
 	Allow(ctx context.Context, req *Request) (context.Context, bool)
 }
 
+// NameRuleSet can be implemented by a RuleSet to check requests before
+// their destination is resolved, e.g. to block names without looking
+// them up. req.RealDestAddr() is nil at that point.
+type NameRuleSet interface {
+	AllowName(ctx context.Context, req *Request) (context.Context, bool)
+}
+
 // PermitAll returns a RuleSet which allows all types of connections
 func PermitAll() RuleSet {
 	return &PermitCommand{true, true, true}
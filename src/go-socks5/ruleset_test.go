@@ -1,6 +1,13 @@
 package socks5
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
 	"testing"
 
 	"golang.org/x/net/context"
@@ -22,3 +29,181 @@ func TestPermitCommand(t *testing.T) {
 		t.Fatalf("do not expect associate")
 	}
 }
+
+// phaseRules records what each phase of the rules sees
+type phaseRules struct {
+	mu       sync.Mutex
+	denyName string
+	denyIP   net.IP
+	names    []string
+	checked  []string
+}
+
+func (r *phaseRules) AllowName(ctx context.Context, req *Request) (context.Context, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.RealDestAddr() != nil {
+		panic("destination rewritten before the name check")
+	}
+	r.names = append(r.names, req.DestAddr.String())
+	return ctx, r.denyName == "" || req.DestAddr.FQDN != r.denyName
+}
+
+func (r *phaseRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checked = append(r.checked, req.DestAddr.String()+" -> "+req.RealDestAddr().Address())
+	return ctx, !req.RealDestAddr().IP.Equal(r.denyIP)
+}
+
+// countingResolver resolves every name to 127.0.0.1
+type countingResolver struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (r *countingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names = append(r.names, name)
+	return ctx, net.ParseIP("127.0.0.1"), nil
+}
+
+// runRuleRequest serves a CONNECT to dest through rules, rewriting
+// matching destinations to rewrite, and returns the reply code
+func runRuleRequest(t *testing.T, rules RuleSet, resolver NameResolver, rewrite [2]string, dest []byte) (byte, error) {
+	rewriter := &RuleRewriter{}
+	if rewrite[0] != "" {
+		rule, err := ParseRewriteRule(rewrite[0], rewrite[1])
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		rewriter.SetRules([]RewriteRule{rule})
+	}
+	s := &Server{config: &Config{
+		Rules:    rules,
+		Resolver: resolver,
+		Rewriter: rewriter,
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}}
+	req, err := NewRequest(bytes.NewReader(append([]byte{5, 1, 0}, dest...)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := &MockConn{}
+	err = s.handleRequest(context.Background(), req, resp)
+	out := resp.buf.Bytes()
+	if len(out) < 2 {
+		t.Fatalf("no reply: %v", err)
+	}
+	return out[1], err
+}
+
+func TestRuleSet_NamePhase(t *testing.T) {
+	rules := &phaseRules{denyName: "blocked.example"}
+	resolver := &countingResolver{}
+	dest := append([]byte{fqdnAddress, 15}, "blocked.example"...)
+	dest = append(dest, 0, 80)
+	reply, err := runRuleRequest(t, rules, resolver, [2]string{}, dest)
+	if reply != ruleFailure || err == nil {
+		t.Fatalf("bad: %v %v", reply, err)
+	}
+	// the name was never looked up
+	if len(resolver.names) != 0 || len(rules.checked) != 0 {
+		t.Fatalf("bad: %v %v", resolver.names, rules.checked)
+	}
+	if len(rules.names) != 1 || rules.names[0] != "blocked.example:80" {
+		t.Fatalf("bad: %v", rules.names)
+	}
+}
+
+func TestRuleSet_RewritePhase(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+	requested := []byte{ipv4Address, 192, 0, 2, 1, 1, 187}
+
+	// the rewritten address is checked, not the requested one
+	rules := &phaseRules{denyIP: net.ParseIP("127.0.0.1")}
+	reply, err := runRuleRequest(t, rules, &countingResolver{}, [2]string{"192.0.2.1:443", l.Addr().String()}, requested)
+	if reply != ruleFailure || err == nil || !strings.Contains(err.Error(), "rewritten to "+l.Addr().String()) {
+		t.Fatalf("bad: %v %v", reply, err)
+	}
+	expected := fmt.Sprintf("192.0.2.1:443 -> 127.0.0.1:%d", port)
+	if len(rules.checked) != 1 || rules.checked[0] != expected {
+		t.Fatalf("bad: %v", rules.checked)
+	}
+
+	rules = &phaseRules{denyIP: net.ParseIP("192.0.2.1")}
+	reply, err = runRuleRequest(t, rules, &countingResolver{}, [2]string{"192.0.2.1:443", l.Addr().String()}, requested)
+	if reply != successReply {
+		t.Fatalf("bad: %v %v", reply, err)
+	}
+
+	// a name the destination is rewritten to is resolved first
+	rules = &phaseRules{denyIP: net.ParseIP("127.0.0.1")}
+	resolver := &countingResolver{}
+	reply, err = runRuleRequest(t, rules, resolver, [2]string{"192.0.2.1:443", fmt.Sprintf("local.test:%d", port)}, requested)
+	if reply != ruleFailure || err == nil {
+		t.Fatalf("bad: %v %v", reply, err)
+	}
+	if len(resolver.names) != 1 || resolver.names[0] != "local.test" {
+		t.Fatalf("bad: %v", resolver.names)
+	}
+	if len(rules.checked) != 1 || rules.checked[0] != fmt.Sprintf("192.0.2.1:443 -> 127.0.0.1:%d", port) {
+		t.Fatalf("bad: %v", rules.checked)
+	}
+
+	// a name that is rewritten is never looked up, only its target
+	name := append([]byte{fqdnAddress, 12}, "name.example"...)
+	name = append(name, 1, 187)
+	rules = &phaseRules{denyIP: net.ParseIP("127.0.0.1")}
+	resolver = &countingResolver{}
+	reply, err = runRuleRequest(t, rules, resolver, [2]string{"name.example", fmt.Sprintf("local.test:%d", port)}, name)
+	if reply != ruleFailure || err == nil {
+		t.Fatalf("bad: %v %v", reply, err)
+	}
+	if len(resolver.names) != 1 || resolver.names[0] != "local.test" {
+		t.Fatalf("bad: %v", resolver.names)
+	}
+	if len(rules.checked) != 1 || rules.checked[0] != fmt.Sprintf("name.example:443 -> 127.0.0.1:%d", port) {
+		t.Fatalf("bad: %v", rules.checked)
+	}
+
+	// rewrites by network apply to the address a name resolves to
+	rules = &phaseRules{denyIP: net.ParseIP("127.0.0.1")}
+	resolver = &countingResolver{}
+	reply, err = runRuleRequest(t, rules, resolver, [2]string{"127.0.0.0/8:443", fmt.Sprintf("local.test:%d", port)}, name)
+	if reply != ruleFailure || err == nil {
+		t.Fatalf("bad: %v %v", reply, err)
+	}
+	if len(resolver.names) != 2 || resolver.names[0] != "name.example" || resolver.names[1] != "local.test" {
+		t.Fatalf("bad: %v", resolver.names)
+	}
+	if len(rules.checked) != 1 || rules.checked[0] != fmt.Sprintf("name.example (127.0.0.1):443 -> 127.0.0.1:%d", port) {
+		t.Fatalf("bad: %v", rules.checked)
+	}
+
+	// without a rewrite both are the same
+	rules = &phaseRules{}
+	dest := []byte{ipv4Address, 127, 0, 0, 1, byte(port >> 8), byte(port)}
+	if reply, err := runRuleRequest(t, rules, &countingResolver{}, [2]string{}, dest); reply != successReply {
+		t.Fatalf("bad: %v %v", reply, err)
+	}
+	expected = fmt.Sprintf("127.0.0.1:%d -> 127.0.0.1:%d", port, port)
+	if len(rules.checked) != 1 || rules.checked[0] != expected || len(rules.names) != 1 {
+		t.Fatalf("bad: %v %v", rules.checked, rules.names)
+	}
+}
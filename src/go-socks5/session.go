@@ -0,0 +1,111 @@
+package socks5
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Session describes a client connection that has completed negotiation
+// and is being served. Its byte counts may lag behind by up to a second
+// of transfer while the data is spliced between TCP connections, see
+// spliceInterval.
+type Session struct {
+	// ID is unique within the Server for its lifetime, and is logged as
+	// conn_id
+	ID uint64
+	// Username from the auth context, empty for "No Auth"
+	Username string
+	// AddrSpec of the client
+	RemoteAddr AddrSpec
+	// AddrSpec of the requested destination
+	DestAddr AddrSpec
+	// Name of the listener that accepted the client, see ListenerConfig
+	Listener string
+	// Time the session was established
+	StartTime time.Time
+
+	conn   *ConnWrapper
+	cancel context.CancelFunc
+	killed int32
+}
+
+// ReadBytes returns the number of bytes read from the client so far
+func (s *Session) ReadBytes() int64 {
+	return atomic.LoadInt64(&s.conn.ReadBytes)
+}
+
+// WriteBytes returns the number of bytes written to the client so far
+func (s *Session) WriteBytes() int64 {
+	return atomic.LoadInt64(&s.conn.WriteBytes)
+}
+
+// Close terminates the session by cancelling its context and closing
+// the client connection
+func (s *Session) Close() error {
+	atomic.StoreInt32(&s.killed, 1)
+	s.cancel()
+	return s.conn.Close()
+}
+
+// Killed reports whether the session was terminated with Close
+func (s *Session) Killed() bool {
+	return atomic.LoadInt32(&s.killed) != 0
+}
+
+// sessionTable keeps track of the live sessions of a Server
+type sessionTable struct {
+	lastID   uint64
+	sessions sync.Map
+}
+
+// nextID allocates the ID of a new connection
+func (t *sessionTable) nextID() uint64 {
+	return atomic.AddUint64(&t.lastID, 1)
+}
+
+func (t *sessionTable) add(sess *Session) {
+	t.sessions.Store(sess.ID, sess)
+}
+
+func (t *sessionTable) remove(sess *Session) {
+	t.sessions.Delete(sess.ID)
+}
+
+// Sessions returns a snapshot of the live sessions, ordered by ID
+func (s *Server) Sessions() []*Session {
+	var list []*Session
+	s.sessions.sessions.Range(func(_, v interface{}) bool {
+		list = append(list, v.(*Session))
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// CloseSession terminates the session with the given ID and reports
+// whether it was found
+func (s *Server) CloseSession(id uint64) bool {
+	v, ok := s.sessions.sessions.Load(id)
+	if !ok {
+		return false
+	}
+	v.(*Session).Close()
+	return true
+}
+
+// CloseUserSessions terminates all sessions of the given user and
+// returns how many were closed
+func (s *Server) CloseUserSessions(username string) int {
+	n := 0
+	for _, sess := range s.Sessions() {
+		if sess.Username == username {
+			sess.Close()
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,120 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_Sessions(t *testing.T) {
+	// Create a local listener that holds the connection open
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+	tAddr := target.Addr().(*net.TCPAddr)
+
+	// Create a socks server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	var access bytes.Buffer
+	var closedReason string
+	var closedCount int
+	var serv *Server
+	serv, err = New(&Config{
+		Credentials:  StaticCredentials{"foo": "bar"},
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		AccessLogger: log.New(&access, "", 0),
+		SessionClosed: func(session *Session, reason string) {
+			closedReason = reason
+			closedCount = len(serv.Sessions())
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		serv.ServeConn(conn)
+		close(done)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{5, 1, UserPassAuth})
+	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	req.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(tAddr.Port))
+	req.Write(port)
+	conn.Write(req.Bytes())
+
+	// Wait for the auth and connect replies
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, 2+2+10)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	sessions := serv.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("bad: %v", sessions)
+	}
+	sess := sessions[0]
+	if sess.Username != "foo" || sess.DestAddr.Port != tAddr.Port {
+		t.Fatalf("bad: %v", sess)
+	}
+	if sess.ReadBytes() != int64(req.Len()) {
+		t.Fatalf("bad: %d", sess.ReadBytes())
+	}
+
+	if n := serv.CloseUserSessions("bar"); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+	if n := serv.CloseUserSessions("foo"); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("session was not closed")
+	}
+	if len(serv.Sessions()) != 0 {
+		t.Fatalf("session not removed")
+	}
+	if !bytes.HasSuffix(access.Bytes(), []byte(" killed\n")) {
+		t.Fatalf("bad: %q", access.String())
+	}
+	if closedReason != "killed" || closedCount != 0 {
+		t.Fatalf("bad: %q %d", closedReason, closedCount)
+	}
+	if serv.CloseSession(sess.ID) {
+		t.Fatalf("closed a finished session")
+	}
+}
@@ -1,11 +1,16 @@
 package socks5
 
 import (
-	"bufio"
+	stdcontext "context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
@@ -16,6 +21,9 @@ const (
 	socks5Version = uint8(5)
 )
 
+// ErrServerClosed is returned by Serve and ListenAndServe after Close
+var ErrServerClosed = fmt.Errorf("Server closed")
+
 // Config is used to setup and configure a Server
 type Config struct {
 	// AuthMethods can be provided to implement custom authentication
@@ -41,23 +49,53 @@ type Config struct {
 	// Defaults to NoRewrite.
 	Rewriter AddressRewriter
 
+	// NAT64Prefix, if set, maps global IPv4 destination addresses into
+	// the prefix (RFC 6052) when dialing directly, for proxies that reach
+	// IPv4 only through NAT64. A custom Dial gets the IPv4 address, as it
+	// may use an upstream proxy; see NAT64Address. Rules and the access
+	// log see the IPv4 address. Names are left to the Resolver, see
+	// HostsResolver.
+	NAT64Prefix *net.IPNet
+
 	// BindIP is used for bind or udp associate
 	BindIP net.IP
 
 	// Logger can be used to provide a custom log target.
-	// Defaults to stdout.
-	Logger *log.Logger
+	// Defaults to text records on stdout.
+	Logger *slog.Logger
 
 	// AccessLogger can be used to provide a custom access log target.
 	// Defaults to stdout.
 	AccessLogger *log.Logger
 
-	// ErrorLogger can be used to provide a custom error log target.
-	// Defaults to stdout.
-	ErrorLogger *log.Logger
-
 	// Optional function for dialing out
 	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// FallbackDelay is how long a connection attempt to one address of a
+	// FQDN gets before the next address is tried in parallel (Happy
+	// Eyeballs). Zero means 250ms, negative tries addresses one at a time.
+	FallbackDelay time.Duration
+
+	// HandshakeTimeout bounds the time a client may take to negotiate,
+	// authenticate and send its request. Zero means no limit.
+	HandshakeTimeout time.Duration
+
+	// IdleTimeout closes a relayed connection once no bytes have been
+	// transferred in either direction for this long. Zero means no limit.
+	IdleTimeout time.Duration
+
+	// MaxSessionDuration closes a relayed connection once it has been
+	// open this long, regardless of activity. Zero means no limit.
+	MaxSessionDuration time.Duration
+
+	// SessionClosed is called with the final byte counts once a session
+	// ends and has been removed from Sessions, e.g. to aggregate usage.
+	SessionClosed func(session *Session, reason string)
+
+	// ALPNHandlers take over TLS connections that negotiated their ALPN
+	// protocol, see ServeTLS. The connection is closed once the handler
+	// returns.
+	ALPNHandlers map[string]func(conn net.Conn)
 }
 
 // ConnWrapper is a wrapper around a net.Conn that provides a way to log read/write bytes
@@ -88,6 +126,14 @@ func (c *ConnWrapper) Write(b []byte) (int, error) {
 type Server struct {
 	config      *Config
 	authMethods map[uint8]Authenticator
+	sessions    sessionTable
+
+	// ctx is the parent of every connection context, cancelled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
 }
 
 // New creates a new Server and potentially returns an error
@@ -113,12 +159,17 @@ func New(conf *Config) (*Server, error) {
 
 	// Ensure we have a log target
 	if conf.Logger == nil {
-		conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
+		conf.Logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+	}
+	if conf.AccessLogger == nil {
+		conf.AccessLogger = log.New(os.Stdout, "", log.LstdFlags)
 	}
 
 	server := &Server{
-		config: conf,
+		config:    conf,
+		listeners: make(map[net.Listener]struct{}),
 	}
+	server.ctx, server.cancel = context.WithCancel(context.Background())
 
 	server.authMethods = make(map[uint8]Authenticator)
 
@@ -140,82 +191,286 @@ func (s *Server) ListenAndServe(network, addr string) error {
 
 // Serve is used to serve connections from a listener
 func (s *Server) Serve(l net.Listener) error {
+	return s.serve(l, nil)
+}
+
+// serve accepts connections from l until it fails or the server is
+// closed, serving them with the listener policy p if not nil
+func (s *Server) serve(l net.Listener, p *listenerPolicy) error {
+	s.mu.Lock()
+	if s.ctx.Err() != nil {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.ctx.Err() != nil {
+				return ErrServerClosed
+			}
 			return err
 		}
-		go s.ServeConn(conn)
+		go s.serveConn(conn, p)
 	}
-	return nil
+}
+
+// Close closes the listeners passed to Serve and cancels the context of
+// every connection, which terminates them
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancel()
+	var err error
+	for l := range s.listeners {
+		if e := l.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
 }
 
 // ServeConn is used to serve a single connection.
 func (s *Server) ServeConn(conn net.Conn) error {
+	return s.serveConn(conn, nil)
+}
+
+func (s *Server) serveConn(conn net.Conn, p *listenerPolicy) error {
 	defer conn.Close()
 
 	// Wrap the connection to log read/write bytes
 	wrappedConn := &ConnWrapper{Conn: conn}
 
-	remoteAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
-	if !ok {
+	// Clients of Unix sockets have no address, they are identified by
+	// the socket and their peer credentials
+	var client string
+	var clientAddr *AddrSpec
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		client = addr.String()
+		clientAddr = &AddrSpec{IP: addr.IP, Port: addr.Port}
+	case *net.UnixAddr:
+		client = "unix:" + conn.LocalAddr().String()
+		clientAddr = &AddrSpec{FQDN: client}
+	default:
 		return fmt.Errorf("Invalid remote address type: %T", conn.RemoteAddr())
 	}
-	bufConn := bufio.NewReader(wrappedConn)
+	// The handshake is read through a small pooled buffer, given back
+	// once the session is relayed
+	bufConn := newHandshakeReader(wrappedConn)
+	defer bufConn.release()
+
+	// Every record about this connection carries its ID
+	id := s.sessions.nextID()
+
+	// Behind a trusted proxy the client is the source address of the
+	// PROXY protocol header
+	remoteAddr := conn.RemoteAddr()
+	var proxy string
+	if p != nil && p.TrustProxy != nil && p.TrustProxy(remoteAddr) {
+		if s.config.HandshakeTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
+		}
+		source, n, err := readProxyHeader(bufConn.buf)
+		// the header is not client traffic
+		atomic.AddInt64(&wrappedConn.ReadBytes, -int64(n))
+		if err != nil {
+			s.config.Logger.Warn("PROXY protocol error", "conn_id", id, "proxy", client, "err", err)
+			return err
+		}
+		if source != nil {
+			proxy = client
+			remoteAddr = source
+			client = source.String()
+			clientAddr = &AddrSpec{IP: source.IP, Port: source.Port}
+		}
+	}
 
-	// Read the version byte
-	version := []byte{0}
-	if _, err := bufConn.Read(version); err != nil {
-		s.config.Logger.Printf("[ERR] socks %s: Failed to get version byte: %v", remoteAddr, err)
-		return err
+	logger := s.config.Logger.With("conn_id", id, "client", client)
+	if proxy != "" {
+		logger = logger.With("proxy", proxy)
+	}
+	cred := unixPeerCred(conn)
+	if cred != nil {
+		logger = logger.With("peer_pid", cred.PID, "peer_uid", cred.UID)
+	}
+	var listener string
+	if p != nil && p.Name != "" {
+		listener = p.Name
+		logger = logger.With("listener", listener)
+	}
+	if p != nil && p.AllowClient != nil && !p.AllowClient(remoteAddr) {
+		logger.Warn("client not allowed on listener")
+		return fmt.Errorf("Client %v not allowed on listener %q", client, listener)
+	}
+	// Past the PROXY protocol header, the rest of the connection is TLS
+	if p != nil && p.TLSConfig != nil {
+		conn = tls.Server(bufConn.detach(conn), p.TLSConfig)
+		defer conn.Close()
+		wrappedConn = &ConnWrapper{Conn: conn}
+		bufConn = newHandshakeReader(wrappedConn)
+		defer bufConn.release()
 	}
 
-	// Ensure we are compatible
-	if version[0] != socks5Version {
-		err := fmt.Errorf("Unsupported SOCKS version: %v", version)
-		s.config.Logger.Printf("[ERR] socks %s: %v", remoteAddr, err)
-		return err
+	// The connection lives until its context is cancelled, by Close or
+	// by killing its session
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	ctx = withConn(ctx, id, clientAddr, logger)
+	if p != nil {
+		ctx = withListener(ctx, p)
+	}
+	if cred != nil {
+		ctx = context.WithValue(ctx, peerCredKey, cred)
 	}
+	// Closing conn ends the session; AfterFunc spares each connection a
+	// goroutine waiting for that
+	stdcontext.AfterFunc(ctx, func() { conn.Close() })
 
-	// Authenticate the connection
-	authContext, err := s.authenticate(conn, bufConn)
-	if err != nil {
-		err = fmt.Errorf("Failed to authenticate: %w", err)
-		s.config.Logger.Printf("[ERR] socks %s: %v", remoteAddr, err)
-		return err
+	// Bound the negotiation phase
+	if s.config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
 	}
 
-	request, err := NewRequest(bufConn)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		var isSOCKS bool
+		var err error
+		ctx, isSOCKS, err = s.handshakeTLS(ctx, tlsConn)
+		if err != nil {
+			logger.Warn("TLS handshake failed", "err", err)
+			return err
+		}
+		if !isSOCKS {
+			return nil
+		}
+	}
+
+	request, err := s.negotiate(ctx, conn, bufConn)
 	if err != nil {
-		if err == unrecognizedAddrType {
+		if errors.Is(err, unrecognizedAddrType) {
 			if err := sendReply(wrappedConn, addrTypeNotSupported, nil); err != nil {
 				return fmt.Errorf("Failed to send reply: %v", err)
 			}
 		}
-		return fmt.Errorf("Failed to read destination address: %v", err)
+		logger.Warn("socks handshake failed", "err", err)
+		return err
+	}
+	authContext := request.AuthContext
+	addClientCert(ctx, authContext)
+	request.RemoteAddr = clientAddr
+
+	// The handshake is done, lift the deadline
+	if s.config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
 	}
-	request.AuthContext = authContext
-	request.RemoteAddr = &AddrSpec{IP: remoteAddr.IP, Port: remoteAddr.Port}
 
-	// log access
-	// remoteAddr, identity, time_now, request, bytes_in, bytes_out
+	// Track the session while it is served
+	session := &Session{
+		ID:         id,
+		Username:   authContext.Payload["Username"],
+		RemoteAddr: *request.RemoteAddr,
+		DestAddr:   *request.DestAddr,
+		Listener:   listener,
+		StartTime:  time.Now(),
+		conn:       wrappedConn,
+		cancel:     cancel,
+	}
+	s.sessions.add(session)
+	logger = logger.With("user", session.Username, "dest", request.DestAddr.String())
+	ctx = withLogger(withAuthContext(ctx, authContext), logger)
+	logger.Debug("session started")
+
+	// untrack the session and log access once it ends
+	// client, identity, time_now, request, bytes_in, bytes_out, close_reason
+	// and, if the destination was rewritten, the address connected to
+	var reason string
 	defer func() {
-		s.config.AccessLogger.Printf("%s %s %s %s %d %d",
-			remoteAddr,
+		s.sessions.remove(session)
+		if s.config.SessionClosed != nil {
+			s.config.SessionClosed(session, reason)
+		}
+		logger.Debug("session closed", "reason", reason,
+			"bytes_in", session.ReadBytes(), "bytes_out", session.WriteBytes())
+		var realDest string
+		if request.Rewritten() {
+			realDest = " " + request.realDestAddr.Address()
+		}
+		s.config.AccessLogger.Printf("%s %s %s %s %d %d %s%s",
+			client,
 			authContext.Payload["Username"],
 			time.Now().Format(time.RFC3339),
 			request.DestAddr.String(),
-			wrappedConn.ReadBytes,
-			wrappedConn.WriteBytes,
+			session.ReadBytes(),
+			session.WriteBytes(),
+			reason,
+			realDest,
 		)
 	}()
 
 	// Process the client request
-	if err := s.handleRequest(request, wrappedConn); err != nil {
+	err = s.handleRequest(ctx, request, wrappedConn)
+	reason = closeReason(err)
+	if session.Killed() {
+		reason = "killed"
+	} else if s.ctx.Err() != nil {
+		reason = "shutdown"
+	}
+	if err != nil {
 		err = fmt.Errorf("Failed to handle request: %v", err)
-		s.config.Logger.Printf("[ERR] socks %s: %v", remoteAddr, err)
+		logger.Error("socks request failed", "err", err)
 		return err
 	}
 
 	return nil
 }
+
+// negotiate reads the version byte, authenticates the client and reads
+// its request. Every read is a full read, so a short or malformed
+// message fails instead of being silently misparsed.
+func (s *Server) negotiate(ctx context.Context, conn io.Writer, bufConn io.Reader) (*Request, error) {
+	// Read the version byte
+	version := []byte{0}
+	if _, err := io.ReadFull(bufConn, version); err != nil {
+		return nil, fmt.Errorf("Failed to get version byte: %w", err)
+	}
+
+	// Ensure we are compatible
+	if version[0] != socks5Version {
+		return nil, fmt.Errorf("Unsupported SOCKS version: %v", version)
+	}
+
+	// Authenticate the connection
+	authContext, err := s.authenticate(ctx, conn, bufConn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to authenticate: %w", err)
+	}
+
+	request, err := NewRequest(bufConn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read destination address: %w", err)
+	}
+	request.AuthContext = authContext
+	return request, nil
+}
+
+// closeReason classifies the result of handleRequest for the access log
+func closeReason(err error) string {
+	switch {
+	case err == nil:
+		return "closed"
+	case errors.Is(err, ErrIdleTimeout):
+		return "idle-timeout"
+	case errors.Is(err, ErrSessionExpired):
+		return "session-expired"
+	default:
+		return "error"
+	}
+}
@@ -5,10 +5,13 @@ import (
 	"encoding/binary"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"testing"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 func TestSOCKS5_Connect(t *testing.T) {
@@ -20,17 +23,20 @@ func TestSOCKS5_Connect(t *testing.T) {
 	go func() {
 		conn, err := l.Accept()
 		if err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 		defer conn.Close()
 
 		buf := make([]byte, 4)
 		if _, err := io.ReadAtLeast(conn, buf, 4); err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 
 		if !bytes.Equal(buf, []byte("ping")) {
-			t.Fatalf("bad: %v", buf)
+			t.Errorf("bad: %v", buf)
+			return
 		}
 		conn.Write([]byte("pong"))
 	}()
@@ -43,7 +49,7 @@ func TestSOCKS5_Connect(t *testing.T) {
 	cator := UserPassAuthenticator{Credentials: creds}
 	conf := &Config{
 		AuthMethods: []Authenticator{cator},
-		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+		Logger:      slog.New(slog.NewTextHandler(os.Stdout, nil)),
 	}
 	serv, err := New(conf)
 	if err != nil {
@@ -53,7 +59,8 @@ func TestSOCKS5_Connect(t *testing.T) {
 	// Start listening
 	go func() {
 		if err := serv.ListenAndServe("tcp", "127.0.0.1:12365"); err != nil {
-			t.Fatalf("err: %v", err)
+			t.Errorf("err: %v", err)
+			return
 		}
 	}()
 	time.Sleep(10 * time.Millisecond)
@@ -108,3 +115,148 @@ func TestSOCKS5_Connect(t *testing.T) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+func TestSOCKS5_HandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	// Create a socks server with a short handshake timeout
+	conf := &Config{
+		Logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+		HandshakeTimeout: 50 * time.Millisecond,
+	}
+	serv, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// Send the version byte and stall
+	conn.Write([]byte{5})
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the server to hang up, got: %v", err)
+	}
+}
+
+func FuzzNegotiate(f *testing.F) {
+	f.Add([]byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{5, 2, NoAuth, UserPassAuth, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r', 5, 1, 0, 3, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0, 80})
+	f.Add([]byte{5, 1, UserPassAuth, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'z', 5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{5, 1, 0x80})
+	f.Add([]byte{5, 0})
+	f.Add([]byte{4, 1, 0, 0, 80, 127, 0, 0, 1, 0})
+	f.Add([]byte{5})
+
+	serv, err := New(&Config{
+		AuthMethods: []Authenticator{
+			UserPassAuthenticator{Credentials: StaticCredentials{"foo": "bar"}},
+		},
+	})
+	if err != nil {
+		f.Fatalf("err: %v", err)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var resp bytes.Buffer
+		req, err := serv.negotiate(context.Background(), &resp, bytes.NewReader(data))
+		if err != nil {
+			if req != nil {
+				t.Fatalf("request on error: %v", req)
+			}
+			return
+		}
+		if req.AuthContext == nil || req.AuthContext.Payload["Username"] != "foo" {
+			t.Fatalf("bad auth context: %v", req.AuthContext)
+		}
+		if req.DestAddr == nil {
+			t.Fatalf("missing destination")
+		}
+	})
+}
+
+func TestServer_Close(t *testing.T) {
+	// Create a local listener that holds the connection open
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+	tAddr := target.Addr().(*net.TCPAddr)
+
+	closed := make(chan string, 1)
+	serv, err := New(&Config{
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		AccessLogger: log.New(io.Discard, "", 0),
+		SessionClosed: func(session *Session, reason string) {
+			closed <- reason
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- serv.Serve(l)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	req := []byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(tAddr.Port))
+	conn.Write(req)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, 2+10)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := serv.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Fatalf("bad: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Serve did not return")
+	}
+	select {
+	case reason := <-closed:
+		if reason != "shutdown" {
+			t.Fatalf("bad: %q", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("session was not closed")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("client connection not closed: %v", err)
+	}
+	if err := serv.Serve(l); err != ErrServerClosed {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// spliceInterval is how often a relay between TCP connections is
+// interrupted to update the byte counts of the session, and its activity.
+// Only transfers are interrupted, an idle relay costs nothing.
+const spliceInterval = time.Second
+
+// tcpRelay relays a session whose client and target are both plain TCP
+// connections with TCPConn.ReadFrom, which on Linux moves the data
+// within the kernel with splice(2) instead of copying it through user
+// space
+type tcpRelay struct {
+	client *net.TCPConn
+	target *net.TCPConn
+	counts *ConnWrapper
+}
+
+// newTCPRelay returns the tcpRelay of a session, if conn and bufConn are
+// the ConnWrapper and drained handshakeReader of a TCP client and target
+// is TCP too
+func newTCPRelay(conn io.Writer, bufConn io.Reader, target net.Conn) (*tcpRelay, bool) {
+	counts, ok := conn.(*ConnWrapper)
+	if !ok {
+		return nil, false
+	}
+	r := &tcpRelay{counts: counts}
+	if r.client, ok = counts.Conn.(*net.TCPConn); !ok {
+		return nil, false
+	}
+	if r.target, ok = target.(*net.TCPConn); !ok {
+		return nil, false
+	}
+	if hs, ok := bufConn.(*handshakeReader); !ok || hs.buf != nil {
+		return nil, false
+	}
+	return r, true
+}
+
+// start relays both directions, sending their result to errCh. The
+// counts and *last, if not nil, are updated at least every interval.
+func (r *tcpRelay) start(errCh chan error, last *int64, interval time.Duration) {
+	go func() {
+		errCh <- spliceCopy(r.target, r.client, &r.counts.ReadBytes, last, interval)
+	}()
+	go func() {
+		errCh <- spliceCopy(r.client, r.target, &r.counts.WriteBytes, last, interval)
+	}()
+}
+
+// spliceCopy copies src to dst until EOF and closes the write side of
+// dst. A read deadline interrupts the transfer every interval to add the
+// bytes moved so far to *count and, if there were any, to record the
+// activity in *last. Between transfers it waits for src to be readable
+// first, so that an idle relay does not hold on to the pipe of a splice.
+func spliceCopy(dst, src *net.TCPConn, count, last *int64, interval time.Duration) error {
+	for {
+		src.SetReadDeadline(time.Time{})
+		if err := waitReadable(src); err != nil {
+			dst.CloseWrite()
+			return err
+		}
+		src.SetReadDeadline(time.Now().Add(interval))
+		n, err := dst.ReadFrom(src)
+		atomic.AddInt64(count, n)
+		if n > 0 {
+			touch(last)
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		dst.CloseWrite()
+		return err
+	}
+}
+
+// touch records activity in last, if not nil
+func touch(last *int64) {
+	if last != nil {
+		atomic.StoreInt64(last, time.Now().UnixNano())
+	}
+}
@@ -0,0 +1,66 @@
+//go:build unix
+
+package socks5
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// cpuTime returns the user and system CPU time of the process
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// benchmarkRelay uploads b.N chunks through relay and reports the CPU
+// time of the whole process per chunk, the ends included
+func benchmarkRelay(b *testing.B, splice bool) {
+	s := &Server{config: &Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}}
+	clientEnd, client := tcpPair(b)
+	target, targetEnd := tcpPair(b)
+	defer clientEnd.Close()
+	defer targetEnd.Close()
+	if !splice {
+		// hiding the TCPConn falls back to copying through buffers
+		target = struct{ net.Conn }{target}
+	}
+	wrapped := &ConnWrapper{Conn: client}
+	go s.relay(context.Background(), wrapped, newHandshakeReader(wrapped), target)
+
+	chunk := make([]byte, 128<<10)
+	sunk := make(chan struct{})
+	go func() {
+		io.CopyN(io.Discard, targetEnd, int64(b.N*len(chunk)))
+		close(sunk)
+	}()
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	start := cpuTime()
+	for i := 0; i < b.N; i++ {
+		if _, err := clientEnd.Write(chunk); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+	<-sunk
+	b.StopTimer()
+	b.ReportMetric(float64(cpuTime()-start)/float64(b.N), "cpu-ns/op")
+}
+
+// Compare with:
+//
+//	go test -run '^$' -bench Relay -benchtime 2000x
+func BenchmarkRelay_Splice(b *testing.B) {
+	benchmarkRelay(b, true)
+}
+
+func BenchmarkRelay_Copy(b *testing.B) {
+	benchmarkRelay(b, false)
+}
@@ -0,0 +1,21 @@
+package socks5
+
+import "syscall"
+
+// canWaitReadable tells if waitReadable waits for data
+const canWaitReadable = true
+
+// waitReadable blocks until conn has data, is at EOF or has failed,
+// without reading anything. Errors of the socket are left for the next
+// read to report.
+func waitReadable(conn syscall.Conn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var b [1]byte
+	return raw.Read(func(fd uintptr) bool {
+		_, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		return err != syscall.EAGAIN
+	})
+}
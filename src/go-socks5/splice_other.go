@@ -0,0 +1,14 @@
+//go:build !linux
+
+package socks5
+
+import "syscall"
+
+// canWaitReadable tells if waitReadable waits for data
+const canWaitReadable = false
+
+// waitReadable is a no-op where TCPConn.ReadFrom does not splice and so
+// holds nothing while it waits
+func waitReadable(conn syscall.Conn) error {
+	return nil
+}
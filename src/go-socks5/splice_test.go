@@ -0,0 +1,192 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+// connectThrough opens a session to target through serv and returns the
+// client connection, ready to relay
+func connectThrough(t testing.TB, serv *Server, target net.Addr) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	port := target.(*net.TCPAddr).Port
+	conn.Write([]byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[3] != successReply {
+		t.Fatalf("bad: %v %v", reply, err)
+	}
+	return conn
+}
+
+func TestNewTCPRelay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	wrapped := &ConnWrapper{Conn: conn}
+	hs := newHandshakeReader(wrapped)
+	if _, ok := newTCPRelay(wrapped, hs, conn); ok {
+		t.Fatalf("spliced before draining the handshake buffer")
+	}
+	hs.drain(io.Discard)
+	if _, ok := newTCPRelay(wrapped, hs, conn); !ok {
+		t.Fatalf("TCP connections not spliced")
+	}
+	if _, ok := newTCPRelay(wrapped, hs, struct{ net.Conn }{conn}); ok {
+		t.Fatalf("wrapped target spliced")
+	}
+	if _, ok := newTCPRelay(&MockConn{}, bytes.NewReader(nil), conn); ok {
+		t.Fatalf("mock client spliced")
+	}
+}
+
+func TestServer_SpliceRelay(t *testing.T) {
+	up := make([]byte, 1<<20)
+	down := make([]byte, 512<<10)
+	rand.Read(up)
+	rand.Read(down)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	received := make(chan []byte, 1)
+	reply := make(chan struct{})
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, len(up))
+		io.ReadFull(conn, buf)
+		received <- buf
+		<-reply
+		conn.Write(down)
+		conn.(*net.TCPConn).CloseWrite()
+		io.Copy(io.Discard, conn)
+	}()
+
+	closed := make(chan *Session, 1)
+	serv, err := New(&Config{
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		AccessLogger: log.New(io.Discard, "", 0),
+		// splices are interrupted every 100ms
+		IdleTimeout: 200 * time.Millisecond,
+		SessionClosed: func(session *Session, reason string) {
+			closed <- session
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Close()
+	conn := connectThrough(t, serv, target.Addr())
+	defer conn.Close()
+
+	conn.Write(up)
+	if buf := <-received; !bytes.Equal(buf, up) {
+		t.Fatalf("corrupted upload")
+	}
+	// the counts of a live session follow the transfer
+	deadline := time.Now().Add(time.Second)
+	for {
+		sessions := serv.Sessions()
+		if len(sessions) == 1 && sessions[0].ReadBytes() == int64(13+len(up)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %v", sessions)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(reply)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	// the target closing its side is passed on to the client
+	if buf, err := io.ReadAll(conn); err != nil || !bytes.Equal(buf, down) {
+		t.Fatalf("corrupted download: %v", err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	select {
+	case session := <-closed:
+		// the method selection is written before counting starts
+		if session.ReadBytes() != int64(13+len(up)) || session.WriteBytes() != int64(10+len(down)) {
+			t.Fatalf("bad: %d %d", session.ReadBytes(), session.WriteBytes())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("session not closed")
+	}
+}
+
+func TestServer_SpliceRelay_IdleTimeout(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	reasons := make(chan string, 1)
+	serv, err := New(&Config{
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		AccessLogger: log.New(io.Discard, "", 0),
+		IdleTimeout:  100 * time.Millisecond,
+		SessionClosed: func(session *Session, reason string) {
+			reasons <- reason
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Close()
+	conn := connectThrough(t, serv, target.Addr())
+	defer conn.Close()
+
+	// traffic keeps the session alive
+	for i := 0; i < 10; i++ {
+		conn.Write([]byte("x"))
+		time.Sleep(30 * time.Millisecond)
+	}
+	select {
+	case reason := <-reasons:
+		t.Fatalf("closed while active: %s", reason)
+	default:
+	}
+	select {
+	case reason := <-reasons:
+		if reason != "idle-timeout" {
+			t.Fatalf("bad: %s", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("session not closed")
+	}
+}
@@ -0,0 +1,143 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ALPNProtocol is the ALPN protocol ID clients may offer for SOCKS over
+// TLS. Clients that offer none are served as SOCKS as well.
+const ALPNProtocol = "socks5"
+
+// ClientCertPayload is the AuthContext.Payload key holding the subject of
+// the verified client certificate of a TLS connection
+const ClientCertPayload = "ClientCertificate"
+
+// ServeTLS is used to serve SOCKS over TLS connections from a listener.
+// Connections that negotiate an ALPN protocol with a handler in
+// Config.ALPNHandlers are passed to it instead, so the port can be shared
+// with other services.
+func (s *Server) ServeTLS(l net.Listener, config *tls.Config) error {
+	return s.Serve(tls.NewListener(l, config))
+}
+
+// ListenAndServeTLS is used to create a TLS listener and serve on it
+func (s *Server) ListenAndServeTLS(network, addr string, config *tls.Config) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(l, config)
+}
+
+// handshakeTLS completes the handshake of a TLS connection. It returns
+// false if the connection was handed to an ALPN handler.
+func (s *Server) handshakeTLS(ctx context.Context, conn *tls.Conn) (context.Context, bool, error) {
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return ctx, false, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	state := conn.ConnectionState()
+	if proto := state.NegotiatedProtocol; proto != "" && proto != ALPNProtocol {
+		handler, ok := s.config.ALPNHandlers[proto]
+		if !ok {
+			return ctx, false, fmt.Errorf("No handler for ALPN protocol %q", proto)
+		}
+		// the handler owns the connection from now on
+		conn.SetDeadline(time.Time{})
+		handler(conn)
+		return ctx, false, nil
+	}
+	return context.WithValue(ctx, tlsStateKey, &state), true, nil
+}
+
+// TLSConnectionState returns the TLS state of the connection a request
+// context belongs to, if it was accepted by ServeTLS
+func TLSConnectionState(ctx context.Context) (*tls.ConnectionState, bool) {
+	state, ok := ctx.Value(tlsStateKey).(*tls.ConnectionState)
+	return state, ok
+}
+
+// addClientCert records the subject of a verified client certificate in
+// the AuthContext
+func addClientCert(ctx context.Context, authContext *AuthContext) {
+	state, ok := TLSConnectionState(ctx)
+	if !ok || len(state.VerifiedChains) == 0 {
+		return
+	}
+	if authContext.Payload == nil {
+		authContext.Payload = make(map[string]string)
+	}
+	authContext.Payload[ClientCertPayload] = state.VerifiedChains[0][0].Subject.String()
+}
+
+// CertReloader serves a certificate and key from files, loading them
+// again whenever either file changes, so renewed certificates are used
+// without a restart. If a new pair fails to load, the previous one is
+// kept.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+	// Logger receives reload errors. Defaults to slog.Default().
+	Logger *slog.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// NewCertReloader loads the certificate and key
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate and key if they changed since the last
+// load
+func (r *CertReloader) Reload() error {
+	certInfo, err := os.Stat(r.CertFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.KeyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.certMod, r.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := r.Reload(); err != nil {
+		logger := r.Logger
+		if logger == nil {
+			logger = slog.Default()
+		}
+		logger.Warn("failed to reload TLS certificate, keeping the previous one",
+			"cert", r.CertFile, "key", r.KeyFile, "err", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
@@ -0,0 +1,231 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for name, for servers if dnsName is set and
+// for clients otherwise
+func (ca *testCA) issue(t *testing.T, name string, serial int64, dnsName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"ganted"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if dnsName != "" {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = []string{dnsName}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCert stores a certificate and its key as PEM files
+func writeCert(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "proxy", 2, "proxy.example")
+	clientCert := ca.issue(t, "alice", 3, "")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("pong"))
+	}()
+	targetAddr := target.Addr().(*net.TCPAddr)
+
+	rules := &recordingRules{allow: true}
+	addr := startTLSServer(t, &Config{
+		Rules:  rules,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.pool,
+		NextProtos:   []string{ALPNProtocol},
+	})
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		RootCAs:      ca.pool,
+		ServerName:   "proxy.example",
+		Certificates: []tls.Certificate{clientCert},
+		NextProtos:   []string{ALPNProtocol},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != ALPNProtocol {
+		t.Fatalf("bad: %q", proto)
+	}
+	conn.Write([]byte{5, 1, NoAuth, 5, 1, 0, 1, 127, 0, 0, 1, byte(targetAddr.Port >> 8), byte(targetAddr.Port)})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	out, _ := io.ReadAll(conn)
+	if len(out) < 4 || out[3] != successReply || !bytes.HasSuffix(out, []byte("pong")) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	if seen := rules.last(); !seen.tls || seen.subject != "CN=alice,O=ganted" {
+		t.Fatalf("bad: %v %q", seen.tls, seen.subject)
+	}
+}
+
+func TestServeTLS_ALPNHandler(t *testing.T) {
+	ca := newTestCA(t)
+	addr := startTLSServer(t, &Config{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		ALPNHandlers: map[string]func(net.Conn){
+			"http/1.1": func(conn net.Conn) {
+				conn.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+			},
+		},
+	}, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "proxy", 2, "proxy.example")},
+		NextProtos:   []string{ALPNProtocol, "http/1.1"},
+	})
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		RootCAs:    ca.pool,
+		ServerName: "proxy.example",
+		NextProtos: []string{"http/1.1"},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	out, _ := io.ReadAll(conn)
+	if string(out) != "HTTP/1.1 204 No Content\r\n\r\n" {
+		t.Fatalf("bad: %q", out)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, ca.issue(t, "proxy", 2, "proxy.example"), certFile, keyFile)
+
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	r.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	serial := func() int64 {
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+	if serial() != 2 {
+		t.Fatalf("bad serial")
+	}
+
+	// a renewed certificate is picked up
+	writeCert(t, ca.issue(t, "proxy", 3, "proxy.example"), certFile, keyFile)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	if serial() != 3 {
+		t.Fatalf("certificate not reloaded")
+	}
+
+	// a broken one is ignored
+	os.WriteFile(keyFile, []byte("garbage"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	if serial() != 3 {
+		t.Fatalf("previous certificate not kept")
+	}
+
+	if _, err := NewCertReloader(certFile, filepath.Join(dir, "missing.pem")); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -12,3 +12,5 @@ require (
 	golang.org/x/net v0.25.0
 	layeh.com/radius v0.0.0-20231213012653-1006025d24f8
 )
+
+require golang.org/x/crypto v0.23.0 // indirect
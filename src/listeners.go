@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/armon/go-socks5"
+)
+
+// listenerSpec is a SOCKS listener from GANTED_LISTENERS
+type listenerSpec struct {
+	name    string
+	network string
+	addr    string
+	tls     bool
+}
+
+// listenersFromEnv reads GANTED_LISTENERS, comma-separated name=address
+// pairs such as v4=0.0.0.0:6626,v6=[::]:6626,tls=tls://:6627,
+// local=unix:/run/ganted/socks.sock. Without it
+// the listeners are GANTED_LISTEN, named default, and GANTED_TLS_LISTEN,
+// named tls, if set.
+func listenersFromEnv() ([]listenerSpec, error) {
+	pairs, err := splitPairs(getEnv("GANTED_LISTENERS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("listeners: %w", err)
+	}
+	if len(pairs) == 0 {
+		pairs = append(pairs, [2]string{"default", getEnv("GANTED_LISTEN", "127.0.0.1:6626")})
+		if addr := getEnv("GANTED_TLS_LISTEN", ""); addr != "" {
+			pairs = append(pairs, [2]string{"tls", "tls://" + addr})
+		}
+	}
+	var specs []listenerSpec
+	seen := make(map[string]bool)
+	for _, pair := range pairs {
+		spec, err := parseListenAddr(pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		if seen[envKey(spec.name)] {
+			return nil, fmt.Errorf("duplicate listener %q", spec.name)
+		}
+		seen[envKey(spec.name)] = true
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// parseListenAddr parses the address of listener name: host:port,
+// unix:path or systemd:name, the socket with that FileDescriptorName
+// passed by systemd socket activation, optionally prefixed with tls://.
+// A listener on an IPv6 address only accepts IPv6, so the same port can
+// be used by another listener on an IPv4 address.
+func parseListenAddr(name, s string) (listenerSpec, error) {
+	spec := listenerSpec{name: name, network: "tcp"}
+	if name == "" {
+		return spec, fmt.Errorf("missing name of listener %q", s)
+	}
+	spec.addr, spec.tls = strings.CutPrefix(s, "tls://")
+	for _, network := range []string{"unix", "systemd"} {
+		if addr, ok := strings.CutPrefix(spec.addr, network+":"); ok {
+			if addr == "" {
+				return spec, fmt.Errorf("listener %s: missing %s socket", name, network)
+			}
+			spec.network, spec.addr = network, addr
+			return spec, nil
+		}
+	}
+	host, _, err := net.SplitHostPort(spec.addr)
+	if err != nil {
+		return spec, fmt.Errorf("listener %s: %w", name, err)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			spec.network = "tcp4"
+		} else {
+			spec.network = "tcp6"
+		}
+	}
+	return spec, nil
+}
+
+// envKey returns the form of a listener or profile name used in
+// environment variables
+func envKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// listenerPolicy builds the socks5.ListenerConfig of spec from
+// GANTED_LISTENER_<NAME>_AUTH, the comma-separated auth methods offered
+// (password, cert, peercred or none), GANTED_LISTENER_<NAME>_ACL, the
+// ACL profile whose networks are read from GANTED_ACL_<PROFILE> instead
+// of GANTED_ACL, GANTED_LISTENER_<NAME>_CLIENTS, the networks clients
+// may connect from, and GANTED_LISTENER_<NAME>_PROXY_PROTOCOL, the
+// networks of the load balancers whose connections start with a PROXY
+// protocol header. The ACLs are added to acls by environment variable so
+// they are reloaded with it. TLS listeners are served with tlsConfig,
+// after the PROXY protocol header if there is one. network is that of
+// the listener opened for spec, "tcp" or "unix", which for sockets from
+// systemd is only known once they are.
+func listenerPolicy(spec listenerSpec, network string, methods map[string]socks5.Authenticator, acls map[string]*ACL, nat64Prefix *net.IPNet, tlsConfig *tls.Config) (*socks5.ListenerConfig, error) {
+	prefix := "GANTED_LISTENER_" + envKey(spec.name) + "_"
+	conf := &socks5.ListenerConfig{Name: spec.name}
+	if spec.tls {
+		conf.TLSConfig = tlsConfig
+	}
+
+	auth := getEnv(prefix+"AUTH", "")
+	if auth == "" && spec.tls && methods["cert"] != nil {
+		auth = "cert,password"
+	} else if auth == "" && network == "unix" {
+		// local users are known by the peer credentials
+		auth = "peercred,password"
+	}
+	for _, method := range strings.Split(auth, ",") {
+		method = strings.TrimSpace(method)
+		if method == "" {
+			continue
+		}
+		a, ok := methods[method]
+		if !ok {
+			return nil, fmt.Errorf("listener %s: unknown auth method %q, expected password, cert, peercred or none", spec.name, method)
+		}
+		if a == nil {
+			return nil, fmt.Errorf("listener %s: auth method cert requires GANTED_TLS_CERT_AUTH", spec.name)
+		}
+		if method == "cert" && !spec.tls {
+			return nil, fmt.Errorf("listener %s: auth method cert requires a tls:// address", spec.name)
+		}
+		conf.AuthMethods = append(conf.AuthMethods, a)
+	}
+
+	if profile := getEnv(prefix+"ACL", ""); profile != "" {
+		key := "GANTED_ACL_" + envKey(profile)
+		if _, ok := acls[key]; !ok {
+			if _, ok := os.LookupEnv(key); !ok {
+				return nil, fmt.Errorf("listener %s: ACL profile %s is not set", spec.name, key)
+			}
+			acl := &ACL{NAT64Prefix: nat64Prefix}
+			if err := acl.Set(getEnv(key, "")); err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			acls[key] = acl
+		}
+		conf.Rules = acls[key]
+	}
+
+	if allowed := getEnv(prefix+"CLIENTS", ""); allowed != "" {
+		if network == "unix" {
+			return nil, fmt.Errorf("listener %s: %sCLIENTS does not apply to Unix sockets", spec.name, prefix)
+		}
+		clients := &ACL{}
+		if err := clients.Set(allowed); err != nil {
+			return nil, fmt.Errorf("%sCLIENTS: %w", prefix, err)
+		}
+		acls[prefix+"CLIENTS"] = clients
+		conf.AllowClient = func(addr net.Addr) bool {
+			tcpAddr, ok := addr.(*net.TCPAddr)
+			return ok && clients.Permitted(tcpAddr.IP)
+		}
+	}
+	if trusted := getEnv(prefix+"PROXY_PROTOCOL", ""); trusted != "" {
+		if network == "unix" {
+			return nil, fmt.Errorf("listener %s: %sPROXY_PROTOCOL does not apply to Unix sockets", spec.name, prefix)
+		}
+		proxies := &ACL{}
+		if err := proxies.Set(trusted); err != nil {
+			return nil, fmt.Errorf("%sPROXY_PROTOCOL: %w", prefix, err)
+		}
+		acls[prefix+"PROXY_PROTOCOL"] = proxies
+		conf.TrustProxy = func(addr net.Addr) bool {
+			tcpAddr, ok := addr.(*net.TCPAddr)
+			return ok && proxies.Permitted(tcpAddr.IP)
+		}
+	}
+	return conf, nil
+}
+
+// listen opens the listeners of specs. TLS is added per connection by
+// the server, see listenerPolicy.
+func listen(specs []listenerSpec) ([]net.Listener, error) {
+	var listeners []net.Listener
+	var activated map[string]net.Listener
+	var err error
+	defer func() {
+		// close what was opened on failure, and the sockets from
+		// systemd no listener uses
+		for _, l := range activated {
+			l.Close()
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+		}
+	}()
+	for _, spec := range specs {
+		var l net.Listener
+		switch spec.network {
+		case "systemd":
+			if activated == nil {
+				if activated, err = systemdListeners(); err != nil {
+					return nil, err
+				}
+			}
+			var ok bool
+			if l, ok = activated[spec.addr]; !ok {
+				err = fmt.Errorf("listener %s: no socket named %s from systemd", spec.name, spec.addr)
+				return nil, err
+			}
+			delete(activated, spec.addr)
+		case "unix":
+			l, err = listenUnix(spec)
+		default:
+			l, err = net.Listen(spec.network, spec.addr)
+		}
+		if err != nil {
+			err = fmt.Errorf("listener %s: %w", spec.name, err)
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenUnix creates the Unix socket of spec with the permissions from
+// GANTED_LISTENER_<NAME>_MODE, 0660 by default, and the group
+// GANTED_LISTENER_<NAME>_GROUP if set
+func listenUnix(spec listenerSpec) (net.Listener, error) {
+	prefix := "GANTED_LISTENER_" + envKey(spec.name) + "_"
+	mode, err := strconv.ParseUint(getEnv(prefix+"MODE", "0660"), 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %sMODE: %w", prefix, err)
+	}
+	gid := -1
+	if group := getEnv(prefix+"GROUP", ""); group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return nil, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	// Remove a stale socket left behind by a previous run
+	if fi, err := os.Lstat(spec.addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(spec.addr)
+	}
+	l, err := net.Listen("unix", spec.addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(spec.addr, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if gid != -1 {
+		if err := os.Chown(spec.addr, -1, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
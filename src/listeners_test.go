@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/armon/go-socks5"
+)
+
+func TestListenerPolicy_DefaultAuth(t *testing.T) {
+	methods := map[string]socks5.Authenticator{
+		"password": &socks5.UserPassAuthenticator{Credentials: socks5.StaticCredentials{}},
+		"none":     socks5.NoAuthAuthenticator{},
+		"peercred": socks5.PeerCredAuthenticator{},
+		"cert":     nil,
+	}
+	for _, c := range []struct {
+		addr    string
+		network string
+		methods []string
+	}{
+		{"127.0.0.1:1080", "tcp", nil},
+		{"unix:/run/ganted/socks.sock", "unix", []string{"peercred", "password"}},
+		// sockets from systemd go by the family of the socket
+		{"systemd:socks", "tcp", nil},
+		{"systemd:local", "unix", []string{"peercred", "password"}},
+	} {
+		spec, err := parseListenAddr("test", c.addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conf, err := listenerPolicy(spec, c.network, methods, map[string]*ACL{}, nil, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(conf.AuthMethods) != len(c.methods) {
+			t.Fatalf("bad: %s: %v", c.addr, conf.AuthMethods)
+		}
+		for i, a := range conf.AuthMethods {
+			if a != methods[c.methods[i]] {
+				t.Fatalf("bad: %s: %v", c.addr, conf.AuthMethods)
+			}
+		}
+	}
+
+	// client networks do not apply to Unix sockets from systemd either
+	t.Setenv("GANTED_LISTENER_TEST_CLIENTS", "10.0.0.0/8")
+	spec, err := parseListenAddr("test", "systemd:local")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := listenerPolicy(spec, "unix", methods, map[string]*ACL{}, nil, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := listenerPolicy(spec, "tcp", methods, map[string]*ACL{}, nil, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
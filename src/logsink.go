@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Syslog severities, shared by the syslog and journald sinks
+const (
+	severityErr     = 3
+	severityWarning = 4
+	severityInfo    = 6
+	severityDebug   = 7
+	// facility daemon
+	syslogFacility = 3
+
+	defaultJournalSocket = "/run/systemd/journal/socket"
+)
+
+// logSinkHelp describes the values accepted by newLogSink
+const logSinkHelp = `file[:path], stdout, stderr, journald[:socket], syslog+udp://host:port, syslog+tcp://host:port or syslog+unix:///dev/log`
+
+// logLevelPattern finds the level of a text or JSON slog record
+var logLevelPattern = regexp.MustCompile(`(?:^|\s)level=(\w+)|"level":"(\w+)"`)
+
+// severityOf picks the severity of a message written to the logger
+// called name from the level of the slog record it contains
+func severityOf(name, msg string) int {
+	if m := logLevelPattern.FindStringSubmatch(msg); m != nil {
+		switch m[1] + m[2] {
+		case "ERROR":
+			return severityErr
+		case "WARN":
+			return severityWarning
+		case "DEBUG":
+			return severityDebug
+		}
+		return severityInfo
+	}
+	if name == "error" {
+		return severityErr
+	}
+	return severityInfo
+}
+
+// newLogSink opens the destination described by spec for the logger
+// called name ("main", "access" or "error")
+func newLogSink(name, spec, logDir string) (io.Writer, error) {
+	if path, ok := fileSinkPath(name, spec, logDir); ok {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	}
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	case "journald":
+		socket := arg
+		if socket == "" {
+			socket = defaultJournalSocket
+		}
+		sink := &journaldSink{socket: socket, name: name}
+		if name == "access" {
+			sink.fields = accessLogFields
+		}
+		return sink, nil
+	case "syslog+udp", "syslog+tcp", "syslog+unix":
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		network, addr := strings.TrimPrefix(u.Scheme, "syslog+"), u.Host
+		if network == "unix" {
+			network, addr = "unixgram", u.Path
+		}
+		if addr == "" {
+			return nil, fmt.Errorf("missing address in %q", spec)
+		}
+		hostname, _ := os.Hostname()
+		return &syslogSink{network: network, addr: addr, hostname: hostname, name: name}, nil
+	}
+	return nil, fmt.Errorf("unknown log sink %q, expected %s", spec, logSinkHelp)
+}
+
+// fileSinkPath returns the path of a file sink, by default
+// <logDir>/<name>.log
+func fileSinkPath(name, spec, logDir string) (string, bool) {
+	kind, path, _ := strings.Cut(spec, ":")
+	if kind != "file" {
+		return "", false
+	}
+	if path == "" {
+		path = filepath.Join(logDir, name+".log")
+	}
+	return path, true
+}
+
+// syslogBacklog is how many messages a syslogSink keeps while it is
+// disconnected; older ones are dropped
+const syslogBacklog = 1000
+
+// syslogSink sends every write as an RFC 5424 message. TCP streams use
+// octet-counting framing (RFC 6587); UDP and Unix sockets send one
+// datagram per message. Connecting happens in the background, so a
+// collector that is down never blocks the writer: messages are kept
+// until it is back, up to syslogBacklog of them.
+type syslogSink struct {
+	network  string
+	addr     string
+	hostname string
+	name     string
+
+	mu      sync.Mutex
+	conn    net.Conn
+	dialing bool
+	pending [][]byte
+	dropped int
+}
+
+func (s *syslogSink) format(msg string, severity int) []byte {
+	hostname := s.hostname
+	if hostname == "" {
+		hostname = "-"
+	}
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	line := fmt.Sprintf("<%d>1 %s %s ganted %d %s - %s",
+		syslogFacility*8+severity,
+		time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		hostname, os.Getpid(), s.name, msg)
+	if s.network == "tcp" {
+		line = strconv.Itoa(len(line)) + " " + line
+	}
+	return []byte(line)
+}
+
+func (s *syslogSink) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	msg := s.format(line, severityOf(s.name, line))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		if _, err := s.conn.Write(msg); err == nil {
+			return len(p), nil
+		}
+		// the collector went away, reconnect
+		s.conn.Close()
+		s.conn = nil
+	}
+	if len(s.pending) == syslogBacklog {
+		s.pending = s.pending[1:]
+		s.dropped++
+	}
+	s.pending = append(s.pending, msg)
+	if !s.dialing {
+		s.dialing = true
+		go s.connect()
+	}
+	return len(p), nil
+}
+
+// connect dials the collector and sends the pending messages, leaving
+// them for the next write to retry if that fails
+func (s *syslogSink) connect() {
+	conn, err := net.DialTimeout(s.network, s.addr, 5*time.Second)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dialing = false
+	if err != nil {
+		return
+	}
+	if s.dropped > 0 {
+		notice := fmt.Sprintf("dropped %d messages while disconnected from %s", s.dropped, s.addr)
+		if _, err := conn.Write(s.format(notice, severityWarning)); err != nil {
+			conn.Close()
+			return
+		}
+		s.dropped = 0
+	}
+	for len(s.pending) > 0 {
+		if _, err := conn.Write(s.pending[0]); err != nil {
+			conn.Close()
+			return
+		}
+		s.pending = s.pending[1:]
+	}
+	s.pending = nil
+	s.conn = conn
+}
+
+// journaldSink writes every message to the systemd journal using its
+// native protocol, so additional fields can be attached to the entry
+type journaldSink struct {
+	socket string
+	name   string
+	// fields extracts structured fields from a message
+	fields func(msg string) map[string]string
+
+	mu   sync.Mutex
+	conn *net.UnixConn
+}
+
+// appendJournalField encodes a field of the journal native protocol
+func appendJournalField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", key, value)
+		return
+	}
+	// values with newlines are length-prefixed
+	buf.WriteString(key + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+func (s *journaldSink) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	var buf bytes.Buffer
+	appendJournalField(&buf, "MESSAGE", msg)
+	appendJournalField(&buf, "PRIORITY", strconv.Itoa(severityOf(s.name, msg)))
+	appendJournalField(&buf, "SYSLOG_IDENTIFIER", "ganted")
+	appendJournalField(&buf, "GANTED_LOG", s.name)
+	if s.fields != nil {
+		for key, value := range s.fields(msg) {
+			if value != "" {
+				appendJournalField(&buf, key, value)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: s.socket, Net: "unixgram"})
+		if err != nil {
+			return 0, err
+		}
+		s.conn = conn
+	}
+	if _, err := s.conn.Write(buf.Bytes()); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// accessLogFields turns an access log line into journal fields
+func accessLogFields(msg string) map[string]string {
+	e, err := parseAccessLogLine(msg)
+	if err != nil {
+		return nil
+	}
+	return map[string]string{
+		"GANTED_CLIENT":           e.Client,
+		"GANTED_USER":             e.Identity,
+		"GANTED_DESTINATION":      e.Destination,
+		"GANTED_REAL_DESTINATION": e.RealDestination,
+		"GANTED_BYTES_IN":         strconv.FormatInt(e.BytesIn, 10),
+		"GANTED_BYTES_OUT":        strconv.FormatInt(e.BytesOut, 10),
+		"GANTED_CLOSE_REASON":     e.Reason,
+	}
+}
+
+// sinkTimestamps reports whether the sink described by spec records the
+// time of every message itself
+func sinkTimestamps(spec string) bool {
+	kind, _, _ := strings.Cut(spec, ":")
+	return kind == "journald" || strings.HasPrefix(kind, "syslog+")
+}
+
+// initLogger points logger to the sink configured for the logger called
+// name, and returns the path of the log file for file sinks, which are
+// rotated
+func initLogger(logger *log.Logger, name, spec, logDir string) (string, error) {
+	w, err := newLogSink(name, spec, logDir)
+	if err != nil {
+		return "", fmt.Errorf("%s log: %w", name, err)
+	}
+	if sinkTimestamps(spec) {
+		logger.SetFlags(logger.Flags() &^ (log.Ldate | log.Ltime))
+	}
+	logger.SetOutput(w)
+	path, _ := fileSinkPath(name, spec, logDir)
+	return path, nil
+}
+
+// logWriter writes slog records through a log.Logger without flags, so
+// the output can be swapped by the LogRotator while records are written
+type logWriter struct {
+	*log.Logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	if err := w.Output(0, string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// newLogHandler creates a "text" or "json" slog handler writing records
+// of at least level to w, without their time if the sink adds it
+func newLogHandler(w io.Writer, format string, level slog.Leveler, timestamps bool) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	if !timestamps {
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+}
+
+// multiHandler passes every record to each of its handlers that accepts
+// its level, so errors can go to the error log as well as the main log
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			if e := h.Handle(ctx, r.Clone()); e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLogSink(t *testing.T) {
+	logDir := filepath.Join(t.TempDir(), "logs")
+	for _, c := range []struct {
+		name string
+		spec string
+		// kind and address of the expected sink
+		want string
+		err  bool
+	}{
+		{"main", "file", "file " + filepath.Join(logDir, "main.log"), false},
+		{"error", "file:" + filepath.Join(logDir, "sub", "err.log"), "file " + filepath.Join(logDir, "sub", "err.log"), false},
+		{"main", "stdout", "stdout", false},
+		{"main", "stderr", "stderr", false},
+		{"main", "journald", "journald " + defaultJournalSocket, false},
+		{"access", "journald:/tmp/journal.sock", "journald /tmp/journal.sock fields", false},
+		{"main", "syslog+udp://127.0.0.1:514", "syslog udp 127.0.0.1:514", false},
+		{"main", "syslog+tcp://[::1]:6514", "syslog tcp [::1]:6514", false},
+		{"main", "syslog+unix:///dev/log", "syslog unixgram /dev/log", false},
+		{"main", "syslog+tcp://", "", true},
+		{"main", "syslog", "", true},
+		{"main", "kafka", "", true},
+	} {
+		w, err := newLogSink(c.name, c.spec, logDir)
+		if (err != nil) != c.err {
+			t.Fatalf("bad: %s: %v", c.spec, err)
+		}
+		if err != nil {
+			continue
+		}
+		var got string
+		switch w := w.(type) {
+		case *os.File:
+			switch w {
+			case os.Stdout:
+				got = "stdout"
+			case os.Stderr:
+				got = "stderr"
+			default:
+				got = "file " + w.Name()
+				w.Close()
+			}
+		case *journaldSink:
+			got = "journald " + w.socket
+			if w.fields != nil {
+				got += " fields"
+			}
+		case *syslogSink:
+			got = "syslog " + w.network + " " + w.addr
+		}
+		if got != c.want {
+			t.Fatalf("bad: %s: %s", c.spec, got)
+		}
+	}
+}
+
+// syslogMessage matches an RFC 5424 message of the main log
+var syslogMessage = regexp.MustCompile(`(?s)^<(\d+)>1 (\S+) testhost ganted (\d+) main - (.*)$`)
+
+// checkSyslogMessage checks the header of msg and returns its priority
+// and content
+func checkSyslogMessage(t *testing.T, msg string) (int, string) {
+	m := syslogMessage.FindStringSubmatch(msg)
+	if m == nil {
+		t.Fatalf("bad: %q", msg)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, m[2]); err != nil {
+		t.Fatalf("bad timestamp: %v", err)
+	}
+	if m[3] != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("bad procid: %s", m[3])
+	}
+	pri, _ := strconv.Atoi(m[1])
+	return pri, m[4]
+}
+
+func TestSyslogSink_UDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	s := &syslogSink{network: "udp", addr: conn.LocalAddr().String(), hostname: "testhost", name: "main"}
+
+	for _, c := range []struct {
+		line string
+		pri  int
+	}{
+		{"level=WARN msg=\"upstream down\"\n", syslogFacility*8 + severityWarning},
+		{`{"level":"ERROR","msg":"failed"}` + "\n", syslogFacility*8 + severityErr},
+		{"plain message\n", syslogFacility*8 + severityInfo},
+	} {
+		if n, err := s.Write([]byte(c.line)); err != nil || n != len(c.line) {
+			t.Fatalf("bad: %d %v", n, err)
+		}
+		buf := make([]byte, 2048)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		// one datagram per message, without framing or newline
+		pri, msg := checkSyslogMessage(t, string(buf[:n]))
+		if pri != c.pri || msg != strings.TrimSuffix(c.line, "\n") {
+			t.Fatalf("bad: %d %q", pri, msg)
+		}
+	}
+}
+
+func TestSyslogSink_TCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	s := &syslogSink{network: "tcp", addr: l.Addr().String(), hostname: "testhost", name: "main"}
+	defer s.close()
+
+	lines := []string{"level=INFO msg=first\n", "level=DEBUG msg=\"with\nnewline\"\n"}
+	for _, line := range lines {
+		if _, err := s.Write([]byte(line)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// octet-counting framing: MSG-LEN SP SYSLOG-MSG, back to back
+	r := bufio.NewReader(conn)
+	for _, line := range lines {
+		msg := readSyslogFrame(t, r)
+		if _, content := checkSyslogMessage(t, msg); content != strings.TrimSuffix(line, "\n") {
+			t.Fatalf("bad: %q", msg)
+		}
+	}
+}
+
+// close closes the connection of s, if any
+func (s *syslogSink) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// readSyslogFrame reads a message with octet-counting framing
+func readSyslogFrame(t *testing.T, r *bufio.Reader) string {
+	size, err := r.ReadString(' ')
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(size, " "))
+	if err != nil {
+		t.Fatalf("bad length %q", size)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return string(msg)
+}
+
+func TestSyslogSink_Reconnect(t *testing.T) {
+	// nothing listens on the collector address
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	down.Close()
+	s := &syslogSink{network: "tcp", addr: down.Addr().String(), hostname: "testhost", name: "main"}
+	defer s.close()
+
+	// writes neither block nor fail, and keep the latest messages
+	start := time.Now()
+	for i := 0; i < syslogBacklog+2; i++ {
+		if _, err := s.Write([]byte("msg=" + strconv.Itoa(i) + "\n")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("writes blocked for %v", time.Since(start))
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	for i := 0; ; i++ {
+		s.mu.Lock()
+		dialing := s.dialing
+		if !dialing {
+			s.addr = l.Addr().String()
+		}
+		s.mu.Unlock()
+		if !dialing {
+			break
+		}
+		if i == 250 {
+			t.Fatalf("still dialing")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := s.Write([]byte("msg=last\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// the drop notice, then what is left of the backlog, in order
+	r := bufio.NewReader(conn)
+	pri, msg := checkSyslogMessage(t, readSyslogFrame(t, r))
+	if pri != syslogFacility*8+severityWarning || !strings.HasPrefix(msg, "dropped 3 messages") {
+		t.Fatalf("bad: %d %q", pri, msg)
+	}
+	for i := 3; i < syslogBacklog+2; i++ {
+		if _, msg := checkSyslogMessage(t, readSyslogFrame(t, r)); msg != "msg="+strconv.Itoa(i) {
+			t.Fatalf("bad: %d: %q", i, msg)
+		}
+	}
+	if _, msg := checkSyslogMessage(t, readSyslogFrame(t, r)); msg != "msg=last" {
+		t.Fatalf("bad: %q", msg)
+	}
+}
+
+// parseJournalEntry decodes a message of the journal native protocol
+func parseJournalEntry(t *testing.T, data []byte) map[string]string {
+	fields := make(map[string]string)
+	for len(data) > 0 {
+		line, rest, ok := bytes.Cut(data, []byte("\n"))
+		if !ok {
+			t.Fatalf("unterminated field %q", data)
+		}
+		if key, value, ok := bytes.Cut(line, []byte("=")); ok {
+			fields[string(key)] = string(value)
+			data = rest
+			continue
+		}
+		// KEY\n, little-endian 64-bit length, value, \n
+		if len(rest) < 8 {
+			t.Fatalf("short field %q", line)
+		}
+		n := binary.LittleEndian.Uint64(rest)
+		rest = rest[8:]
+		if uint64(len(rest)) < n+1 || rest[n] != '\n' {
+			t.Fatalf("bad field %q", line)
+		}
+		fields[string(line)] = string(rest[:n])
+		data = rest[n+1:]
+	}
+	return fields
+}
+
+func TestJournaldSink(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	read := func() map[string]string {
+		buf := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return parseJournalEntry(t, buf[:n])
+	}
+
+	s := &journaldSink{socket: socket, name: "main"}
+	defer func() {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}()
+	if _, err := s.Write([]byte("level=ERROR msg=\"two\nlines\"\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fields := read()
+	for key, want := range map[string]string{
+		"MESSAGE":           "level=ERROR msg=\"two\nlines\"",
+		"PRIORITY":          strconv.Itoa(severityErr),
+		"SYSLOG_IDENTIFIER": "ganted",
+		"GANTED_LOG":        "main",
+	} {
+		if fields[key] != want {
+			t.Fatalf("bad %s: %q", key, fields[key])
+		}
+	}
+
+	access := &journaldSink{socket: socket, name: "access", fields: accessLogFields}
+	defer func() {
+		if access.conn != nil {
+			access.conn.Close()
+		}
+	}()
+	if _, err := access.Write([]byte("192.0.2.7:40000  2026-01-01T00:00:00Z 198.51.100.1:443 10 20 closed\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fields = read()
+	if fields["GANTED_CLIENT"] != "192.0.2.7:40000" || fields["GANTED_LOG"] != "access" || fields["PRIORITY"] != strconv.Itoa(severityInfo) {
+		t.Fatalf("bad: %v", fields)
+	}
+	// empty fields are left out
+	for _, key := range []string{"GANTED_USER", "GANTED_REAL_DESTINATION"} {
+		if _, ok := fields[key]; ok {
+			t.Fatalf("bad: %v", fields)
+		}
+	}
+}
+
+func TestAccessLogFields(t *testing.T) {
+	fields := accessLogFields("192.0.2.7:40000 alice 2026-01-01T00:00:00Z example.com (203.0.113.5):443 1234 5678 idle-timeout 10.0.0.1:8443")
+	for key, want := range map[string]string{
+		"GANTED_CLIENT":           "192.0.2.7:40000",
+		"GANTED_USER":             "alice",
+		"GANTED_DESTINATION":      "example.com:443",
+		"GANTED_REAL_DESTINATION": "10.0.0.1:8443",
+		"GANTED_BYTES_IN":         "1234",
+		"GANTED_BYTES_OUT":        "5678",
+		"GANTED_CLOSE_REASON":     "idle-timeout",
+	} {
+		if fields[key] != want {
+			t.Fatalf("bad %s: %q", key, fields[key])
+		}
+	}
+	if fields := accessLogFields("not an access log line"); fields != nil {
+		t.Fatalf("bad: %v", fields)
+	}
+}
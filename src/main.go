@@ -2,12 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/armon/go-socks5"
@@ -19,32 +27,65 @@ import (
 )
 
 type ACL struct {
-	*netallow.BasicNet
+	// nets is swapped whole, so a reload never leaves it half-parsed
+	nets atomic.Pointer[netallow.BasicNet]
+	// Destinations in the NAT64 prefix are checked by the IPv4 address
+	// they embed
+	NAT64Prefix *net.IPNet
 }
 
-// ACL.Allow implements the socks5.RuleSet interface.
+// ACL.Allow implements the socks5.RuleSet interface. It checks the
+// address connected to, which differs from the requested one when the
+// destination is rewritten.
 func (acl *ACL) Allow(ctx context.Context, request *socks5.Request) (context.Context, bool) {
 	if request.Command != socks5.ConnectCommand {
 		return ctx, false
 	}
-	if !acl.Permitted(request.DestAddr.IP) {
+	ip := request.RealDestAddr().IP
+	if acl.NAT64Prefix != nil {
+		if v4 := socks5.NAT64Extract(acl.NAT64Prefix, ip); v4 != nil {
+			ip = v4
+		}
+	}
+	if !acl.Permitted(ip) {
 		return ctx, false
 	}
-	log.Printf("Accept: %q, %s, %s", request.AuthContext.Payload["Username"], request.RemoteAddr, request.DestAddr)
+	socks5.Logger(ctx).Info("accept")
 	return ctx, true
 }
 
+// ACL.Permitted tells if ip is in one of the networks of the ACL
+func (acl *ACL) Permitted(ip net.IP) bool {
+	nets := acl.nets.Load()
+	return nets != nil && nets.Permitted(ip)
+}
+
 // ACL.String and ACL.Set implement the flag.Value interface.
 func (acl *ACL) String() string {
-	b, _ := json.Marshal(acl.BasicNet)
+	b, _ := json.Marshal(acl.nets.Load())
 	return string(b)
 }
 
 // ACL.String and ACL.Set implement the flag.Value interface.
 func (acl *ACL) Set(s string) error {
+	nets, err := parseNets(s)
+	if err != nil {
+		return err
+	}
+	acl.nets.Store(nets)
+	return nil
+}
+
+// parseNets reads comma-separated networks into a new BasicNet, leaving
+// the ACL in force untouched when one of them is invalid
+func parseNets(s string) (*netallow.BasicNet, error) {
 	r, w := io.Pipe()
 	go json.NewEncoder(w).Encode(s)
-	return json.NewDecoder(r).Decode(acl.BasicNet)
+	nets := netallow.NewBasicNet()
+	if err := json.NewDecoder(r).Decode(nets); err != nil {
+		return nil, err
+	}
+	return nets, nil
 }
 
 type RadiusCredentials struct {
@@ -52,7 +93,11 @@ type RadiusCredentials struct {
 	AccountingServer string
 	Secret           []byte
 	NASIdentifier    string
+	Timeout          time.Duration
 	Cache            RadiusCache
+
+	// serializes the cron job, shutdown and accounting triggered over the control socket
+	accountingLock sync.Mutex
 }
 
 type RadiusCache struct {
@@ -77,8 +122,22 @@ func (r *RadiusCredentials) updateCache(username, password string) {
 	})
 }
 
+// flushCache drops the cached credentials of username, or of every user
+// if username is empty, and returns the number of entries removed
+func (r *RadiusCredentials) flushCache(username string) int {
+	n := 0
+	r.Cache.Map.Range(func(key, value interface{}) bool {
+		if username == "" || key.(string) == username {
+			r.Cache.Map.Delete(key)
+			n++
+		}
+		return true
+	})
+	return n
+}
+
 // RadiusCredentials.Valid implements the socks5.CredentialStore interface.
-func (r *RadiusCredentials) Valid(username, password string) bool {
+func (r *RadiusCredentials) Valid(ctx context.Context, username, password string) bool {
 	if v, ok := r.Cache.Map.Load(username); ok {
 		item := v.(RadiusCacheItem)
 		if item.Password == password && !r.Cache.isExpired(&item) {
@@ -89,9 +148,26 @@ func (r *RadiusCredentials) Valid(username, password string) bool {
 	packet := radius.New(radius.CodeAccessRequest, r.Secret)
 	rfc2865.UserName_SetString(packet, username)
 	rfc2865.UserPassword_SetString(packet, password)
-	response, err := radius.Exchange(context.Background(), packet, r.Server)
+	// the client address, from the PROXY protocol header behind a load
+	// balancer
+	if client, ok := socks5.ClientAddr(ctx); ok {
+		if client.IP != nil {
+			rfc2865.CallingStationID_SetString(packet, client.IP.String())
+		} else {
+			rfc2865.CallingStationID_SetString(packet, client.FQDN)
+		}
+	}
+	// Valid runs inside the SOCKS handshake; don't let an unresponsive
+	// RADIUS server hold the connection open indefinitely. A zero
+	// RADIUS_TIMEOUT leaves it to the handshake timeout.
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	response, err := radius.Exchange(ctx, packet, r.Server)
 	if err != nil {
-		log.Printf("[ERR] Radius error: %s\n", err)
+		socks5.Logger(ctx).Error("radius error", "user", username, "err", err)
 		return false
 	}
 	if response.Code == radius.CodeAccessAccept {
@@ -120,18 +196,17 @@ func (r *RadiusCredentials) StartGCWorker() {
 	go r.gcworker()
 }
 
-func (r *RadiusCredentials) accountingCron(accessLogger, errorLogger *log.Logger) *cron.Cron {
+func (r *RadiusCredentials) accountingCron(usage *UsageAggregator, server *socks5.Server) *cron.Cron {
 	// hourly accounting cron job
 	c := cron.New()
 	_, err := c.AddFunc("@hourly", func() {
 		// accounting
-		err := r.accounting(accessLogger)
-		if err != nil {
-			errorLogger.Printf("Accounting error: %s\n", err)
+		if err := r.accounting(usage, server.Sessions); err != nil {
+			slog.Error("accounting error", "err", err)
 		}
 	})
 	if err != nil {
-		log.Fatalf("[ERR] Failed to add accounting cron job: %s", err)
+		fatal("failed to add accounting cron job", "err", err)
 	}
 	c.Start()
 	return c
@@ -144,59 +219,262 @@ func getEnv(key, def string) string {
 	return def
 }
 
-func init() {
-	log.SetFlags(log.Flags() | log.Lshortfile)
-	// Don't repeat timestamp if logging to systemd journal (v231+)
-	if _, ok := os.LookupEnv("JOURNAL_STREAM"); ok {
-		log.SetFlags(log.Flags() &^ (log.Ldate | log.Ltime))
+// loadEnvFile reads KEY=VALUE lines from filePath into the environment,
+// overriding variables already set. Blank lines and lines starting with
+// '#' are ignored, and values may be wrapped in quotes.
+func loadEnvFile(filePath string) error {
+	if filePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
 	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected KEY=VALUE", filePath, i+1)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		os.Setenv(key, value)
+	}
+	return nil
 }
 
-func init() {
-	// init dir GANTED_LOG_DIR
-	gantedLogDir := getEnv("GANTED_LOG_DIR", "/var/log/ganted")
-	if _, err := os.Stat(gantedLogDir); os.IsNotExist(err) {
-		if err := os.Mkdir(gantedLogDir, 0755); err != nil {
-			log.Fatalf("[ERR] Failed to create ganted log directory %s: %s", gantedLogDir, err)
+// reloadConfig re-reads GANTED_ENV_FILE and applies the settings that
+// can change at runtime, currently the ACLs, keyed by the variable they
+// are read from, the upstream proxies and the destination rewrites
+func reloadConfig(acls map[string]*ACL, upstreams *UpstreamRouter, rewriter *socks5.RuleRewriter) error {
+	if err := loadEnvFile(getEnv("GANTED_ENV_FILE", "")); err != nil {
+		return err
+	}
+	// all the ACLs are parsed before any of them changes, so a typo
+	// leaves the ones in force as they were
+	nets := make(map[string]*netallow.BasicNet, len(acls))
+	for key := range acls {
+		n, err := parseNets(getEnv(key, ""))
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
 		}
+		nets[key] = n
+	}
+	for key, acl := range acls {
+		acl.nets.Store(nets[key])
+	}
+	if err := setUpstreamsFromEnv(upstreams); err != nil {
+		return err
 	}
+	return setRewritesFromEnv(rewriter)
 }
 
+// setRewritesFromEnv applies GANTED_REWRITES, comma-separated
+// match=target pairs such as 149.154.167.51:443=127.0.0.1:8443, to
+// rewriter. The first match wins.
+func setRewritesFromEnv(rewriter *socks5.RuleRewriter) error {
+	pairs, err := splitPairs(getEnv("GANTED_REWRITES", ""))
+	if err != nil {
+		return fmt.Errorf("rewrites: %w", err)
+	}
+	var rules []socks5.RewriteRule
+	for _, pair := range pairs {
+		rule, err := socks5.ParseRewriteRule(pair[0], pair[1])
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	rewriter.SetRules(rules)
+	return nil
+}
+
+// fatal logs an error and exits, like log.Fatal
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// shutdownTimeout bounds how long shutdown waits for closed sessions to
+// report their usage
+const shutdownTimeout = 10 * time.Second
+
+// waitSessions waits until the sessions of server have ended, or timeout
+// has passed, and reports whether they all ended
+func waitSessions(server *socks5.Server, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for len(server.Sessions()) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// rotationPolicyFromEnv reads the log rotation settings
+func rotationPolicyFromEnv() (RotationPolicy, error) {
+	var p RotationPolicy
+	var err error
+	if p.Period, err = time.ParseDuration(getEnv("GANTED_LOG_ROTATE_PERIOD", "1h")); err != nil {
+		return p, err
+	}
+	if p.MaxSize, err = parseSize(getEnv("GANTED_LOG_ROTATE_SIZE", "0")); err != nil {
+		return p, err
+	}
+	if p.ArchiveAfter, err = strconv.Atoi(getEnv("GANTED_LOG_ARCHIVE_AFTER", "24")); err != nil {
+		return p, err
+	}
+	p.Compression = getEnv("GANTED_LOG_COMPRESSION", "zstd")
+	if _, err = p.compressionExt(); err != nil {
+		return p, err
+	}
+	if p.CompressionLevel, err = strconv.Atoi(getEnv("GANTED_LOG_COMPRESSION_LEVEL", "0")); err != nil {
+		return p, err
+	}
+	if p.MaxAge, err = time.ParseDuration(getEnv("GANTED_LOG_MAX_AGE", "0")); err != nil {
+		return p, err
+	}
+	if p.MaxTotalSize, err = parseSize(getEnv("GANTED_LOG_MAX_TOTAL_SIZE", "0")); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// setFileLoggerOutput reopens filePath as the output of logger and
+// closes the previous file
 func setFileLoggerOutput(logger *log.Logger, filePath string) error {
 	if filePath == "" {
 		return nil
 	}
 	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
 	if err != nil {
-		log.Fatalf("[ERR] Failed to open file %s: %s", filePath, err)
+		return err
 	}
 	prevWriter := logger.Writer()
 	logger.SetOutput(file)
-	if closer, ok := prevWriter.(io.Closer); ok {
-		closer.Close()
+	if prevWriter != os.Stdout && prevWriter != os.Stderr {
+		if closer, ok := prevWriter.(io.Closer); ok {
+			closer.Close()
+		}
 	}
 	return nil
 }
 
-func initFileLogger(filePath string) (*log.Logger, error) {
-	logger := log.New(os.Stdout, "", log.LstdFlags)
-	if err := setFileLoggerOutput(logger, filePath); err != nil {
-		return nil, err
+func main() {
+	if filepath.Base(os.Args[0]) == "gantedctl" {
+		os.Exit(ctl(os.Args[1:]))
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ctl":
+			os.Exit(ctl(os.Args[2:]))
+		case "report":
+			os.Exit(report(os.Args[2:]))
+		}
 	}
-	return logger, nil
+	serve()
 }
 
-func main() {
-	listenAddr := getEnv("GANTED_LISTEN", "127.0.0.1:6626")
+// newResolverFromEnv returns the system resolver, or a caching resolver
+// querying GANTED_DNS_SERVERS (comma-separated udp://, tcp://, tls:// or
+// https:// servers) if set. Names in GANTED_HOSTS (name=address|address
+// pairs) and GANTED_HOSTS_FILE resolve to fixed addresses, and with
+// GANTED_NAT64_PREFIX set, IPv4-only names are mapped into the prefix.
+// IPv4 addresses are mapped when dialing, see UpstreamRouter.
+func newResolverFromEnv(nat64Prefix *net.IPNet) (socks5.NameResolver, error) {
+	var resolver socks5.NameResolver = socks5.DNSResolver{}
+	var servers []string
+	for _, s := range strings.Split(getEnv("GANTED_DNS_SERVERS", ""), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) > 0 {
+		timeout, err := time.ParseDuration(getEnv("GANTED_DNS_TIMEOUT", "5s"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid GANTED_DNS_TIMEOUT: %w", err)
+		}
+		negativeTTL, err := time.ParseDuration(getEnv("GANTED_DNS_NEGATIVE_TTL", "30s"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid GANTED_DNS_NEGATIVE_TTL: %w", err)
+		}
+		maxTTL, err := time.ParseDuration(getEnv("GANTED_DNS_MAX_TTL", "1h"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid GANTED_DNS_MAX_TTL: %w", err)
+		}
+		resolver, err = socks5.NewCachingResolver(&socks5.CachingResolver{
+			Servers:     servers,
+			Timeout:     timeout,
+			Prefer:      getEnv("GANTED_DNS_PREFER", socks5.PreferIPv6),
+			NegativeTTL: negativeTTL,
+			MaxTTL:      maxTTL,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hosts := make(map[string][]net.IP)
+	if path := getEnv("GANTED_HOSTS_FILE", ""); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if hosts, err = socks5.ParseHosts(f); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	pairs, err := splitPairs(getEnv("GANTED_HOSTS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("hosts: %w", err)
+	}
+	for _, pair := range pairs {
+		name := strings.ToLower(strings.TrimSuffix(pair[0], "."))
+		var ips []net.IP
+		for _, s := range strings.Split(pair[1], "|") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q for host %s", s, pair[0])
+			}
+			ips = append(ips, ip)
+		}
+		// overrides the hosts file
+		hosts[name] = ips
+	}
+	if len(hosts) == 0 && nat64Prefix == nil {
+		return resolver, nil
+	}
+	return &socks5.HostsResolver{Hosts: hosts, Resolver: resolver, NAT64Prefix: nat64Prefix}, nil
+}
+
+func serve() {
+	if err := loadEnvFile(getEnv("GANTED_ENV_FILE", "")); err != nil {
+		fatal("failed to load environment file", "err", err)
+	}
+	startTime := time.Now()
 	radiusAddr := getEnv("RADIUS_SERVER", "127.0.0.1:1812")
 	radiusSecret := getEnv("RADIUS_SECRET", "")
 	radiusAccountingAddr := getEnv("RADIUS_ACCOUNTING_SERVER", "127.0.0.1:1813")
 	nasIdentifier := getEnv("NAS_IDENTIFIER", "ganted")
-	serverACL := &ACL{BasicNet: netallow.NewBasicNet()}
+	serverACL := &ACL{}
 	err := serverACL.Set(getEnv("GANTED_ACL", ""))
 	if err != nil {
 		panic(err)
 	}
+	if prefix := getEnv("GANTED_NAT64_PREFIX", ""); prefix != "" {
+		if serverACL.NAT64Prefix, err = socks5.ParseNAT64Prefix(prefix); err != nil {
+			panic(err)
+		}
+	}
 	authCacheRetention, err := time.ParseDuration(getEnv("GANTED_AUTH_CACHE_RETENTION", "10m"))
 	if err != nil {
 		panic(err)
@@ -205,11 +483,66 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	radiusTimeout, err := time.ParseDuration(getEnv("RADIUS_TIMEOUT", "5s"))
+	if err != nil {
+		panic(err)
+	}
+	handshakeTimeout, err := time.ParseDuration(getEnv("GANTED_HANDSHAKE_TIMEOUT", "30s"))
+	if err != nil {
+		panic(err)
+	}
+	idleTimeout, err := time.ParseDuration(getEnv("GANTED_IDLE_TIMEOUT", "30m"))
+	if err != nil {
+		panic(err)
+	}
+	maxSessionDuration, err := time.ParseDuration(getEnv("GANTED_MAX_SESSION_DURATION", "0"))
+	if err != nil {
+		panic(err)
+	}
+	fallbackDelay, err := time.ParseDuration(getEnv("GANTED_FALLBACK_DELAY", "250ms"))
+	if err != nil {
+		panic(err)
+	}
+	upstreamRetry, err := time.ParseDuration(getEnv("GANTED_UPSTREAM_RETRY", "30s"))
+	if err != nil {
+		panic(err)
+	}
 
-	dialer := &net.Dialer{}
-	bindAddr := getEnv("GANTED_BIND_OUTPUT", "")
-	if bindAddr != "" {
-		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(bindAddr)}
+	egress, err := newEgressPoolFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	upstreams := &UpstreamRouter{Direct: egress, RetryAfter: upstreamRetry, NAT64Prefix: serverACL.NAT64Prefix}
+	if err := setUpstreamsFromEnv(upstreams); err != nil {
+		panic(err)
+	}
+	resolver, err := newResolverFromEnv(serverACL.NAT64Prefix)
+	if err != nil {
+		panic(err)
+	}
+	rewriter := &socks5.RuleRewriter{}
+	if err := setRewritesFromEnv(rewriter); err != nil {
+		panic(err)
+	}
+	listenerSpecs, err := listenersFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	// SOCKS over TLS, optionally sharing the port with other services
+	// through ALPN
+	var tlsConfig *tls.Config
+	var alpnHandlers map[string]func(net.Conn)
+	for _, spec := range listenerSpecs {
+		if !spec.tls {
+			continue
+		}
+		if tlsConfig, err = newTLSConfigFromEnv(); err != nil {
+			panic(err)
+		}
+		if alpnHandlers, err = alpnFallbacks(tlsConfig); err != nil {
+			panic(err)
+		}
+		break
 	}
 
 	credentials := &RadiusCredentials{
@@ -217,6 +550,7 @@ func main() {
 		AccountingServer: radiusAccountingAddr,
 		Secret:           []byte(radiusSecret),
 		NASIdentifier:    nasIdentifier,
+		Timeout:          radiusTimeout,
 		Cache: RadiusCache{
 			Retention: authCacheRetention,
 			GC:        authCacheGC,
@@ -225,32 +559,171 @@ func main() {
 	gantedLogDir := getEnv("GANTED_LOG_DIR", "/var/log/ganted")
 	credentials.StartGCWorker()
 
-	accessLogger, err := initFileLogger(filepath.Join(gantedLogDir, "access.log"))
+	// Each logger writes to GANTED_<NAME>_LOG, falling back to GANTED_LOG_SINK.
+	// The main log receives the records of at least GANTED_LOG_LEVEL, the
+	// error log only the errors, and the access log a line per session.
+	mainLog := log.New(os.Stderr, "", 0)
+	accessLogger := log.New(os.Stdout, "", log.LstdFlags)
+	errorLog := log.New(os.Stdout, "", 0)
+	mainSink := getEnv("GANTED_MAIN_LOG", getEnv("GANTED_LOG_SINK", "stderr"))
+	accessSink := getEnv("GANTED_ACCESS_LOG", getEnv("GANTED_LOG_SINK", "file"))
+	errorSink := getEnv("GANTED_ERROR_LOG", getEnv("GANTED_LOG_SINK", "file"))
+	var logFiles []*LogRotator
+	for _, l := range []struct {
+		logger     *log.Logger
+		name, sink string
+	}{
+		{mainLog, "main", mainSink},
+		{accessLogger, "access", accessSink},
+		{errorLog, "error", errorSink},
+	} {
+		path, err := initLogger(l.logger, l.name, l.sink, gantedLogDir)
+		if err != nil {
+			fatal("failed to init log", "err", err)
+		}
+		if path != "" {
+			logFiles = append(logFiles, &LogRotator{Logger: l.logger, Path: path})
+		}
+	}
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(getEnv("GANTED_LOG_LEVEL", "info"))); err != nil {
+		panic(err)
+	}
+	logFormat := getEnv("GANTED_LOG_FORMAT", "text")
+	// Don't repeat timestamp if logging to systemd journal (v231+)
+	_, journalStream := os.LookupEnv("JOURNAL_STREAM")
+	mainTimestamps := !sinkTimestamps(mainSink) && !(journalStream && mainSink == "stderr")
+	mainHandler, err := newLogHandler(logWriter{mainLog}, logFormat, logLevel, mainTimestamps)
 	if err != nil {
-		log.Fatalf("[ERR] Failed to init access log: %s", err)
+		panic(err)
 	}
-	errorLogger, err := initFileLogger(filepath.Join(gantedLogDir, "error.log"))
+	errorHandler, err := newLogHandler(logWriter{errorLog}, logFormat, slog.LevelError, !sinkTimestamps(errorSink))
 	if err != nil {
-		log.Fatalf("[ERR] Failed to init error log: %s", err)
+		panic(err)
 	}
-	c := credentials.accountingCron(accessLogger, errorLogger)
-	if c == nil {
-		log.Fatalf("[ERR] Failed to start accounting cron job")
-	} else {
-		defer c.Stop()
+	slog.SetDefault(slog.New(multiHandler{mainHandler, errorHandler}))
+
+	rotationPolicy, err := rotationPolicyFromEnv()
+	if err != nil {
+		fatal("invalid log rotation settings", "err", err)
+	}
+	for _, rotator := range logFiles {
+		rotator.Policy = rotationPolicy
+		if err := rotator.Recover(); err != nil {
+			slog.Error("log archive recovery error", "path", rotator.Path, "err", err)
+		}
+		go rotator.Run(time.Minute)
+	}
+	// The auth methods listeners may offer. By default clients of TLS
+	// listeners with a verified certificate may skip the password.
+	authMethods := map[string]socks5.Authenticator{
+		"password": &socks5.UserPassAuthenticator{Credentials: credentials},
+		"none":     socks5.NoAuthAuthenticator{},
+		"peercred": socks5.PeerCredAuthenticator{},
+		"cert":     nil,
+	}
+	certAuth, err := newCertAuthenticatorFromEnv()
+	if err != nil {
+		panic(err)
 	}
+	if certAuth != nil {
+		authMethods["cert"] = certAuth
+	}
+	// the ACLs applied at reload, by environment variable
+	acls := map[string]*ACL{"GANTED_ACL": serverACL}
+	listeners, err := listen(listenerSpecs)
+	if err != nil {
+		fatal("failed to start socks5 server", "err", err)
+	}
+	var listenerConfigs []*socks5.ListenerConfig
+	for i, spec := range listenerSpecs {
+		conf, err := listenerPolicy(spec, listeners[i].Addr().Network(), authMethods, acls, serverACL.NAT64Prefix, tlsConfig)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			panic(err)
+		}
+		listenerConfigs = append(listenerConfigs, conf)
+	}
+	usage := NewUsageAggregator()
 	server, err := socks5.New(&socks5.Config{
-		Credentials:  credentials,
-		Rules:        serverACL,
-		Logger:       log.Default(),
-		AccessLogger: accessLogger,
-		ErrorLogger:  errorLogger,
-		Dial:         dialer.DialContext,
+		Credentials:        credentials,
+		Rules:              serverACL,
+		Logger:             slog.Default(),
+		AccessLogger:       accessLogger,
+		Resolver:           resolver,
+		Rewriter:           rewriter,
+		Dial:               upstreams.DialContext,
+		FallbackDelay:      fallbackDelay,
+		HandshakeTimeout:   handshakeTimeout,
+		IdleTimeout:        idleTimeout,
+		MaxSessionDuration: maxSessionDuration,
+		SessionClosed:      usage.SessionClosed,
+		ALPNHandlers:       alpnHandlers,
 	})
 	if err != nil {
-		log.Fatalf("[ERR] Create socks5 server: %s", err)
+		fatal("failed to create socks5 server", "err", err)
+	}
+	c := credentials.accountingCron(usage, server)
+	if c == nil {
+		fatal("failed to start accounting cron job")
+	} else {
+		defer c.Stop()
 	}
-	if err := server.ListenAndServe("tcp", listenAddr); err != nil {
-		log.Fatalf("[ERR] Start socks5 server: %s", err)
+	// Usage lives in memory until the next accounting run; send it
+	// before exiting instead of losing it
+	shutdownDone := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		slog.Info("shutting down, sending pending accounting data")
+		server.Close()
+		// Sessions add their usage once they end
+		if !waitSessions(server, shutdownTimeout) {
+			slog.Warn("sessions still open, sending their usage so far", "sessions", len(server.Sessions()))
+		}
+		if err := credentials.accounting(usage, server.Sessions); err != nil {
+			slog.Error("accounting error", "err", err)
+		}
+		close(shutdownDone)
+	}()
+	admin := &AdminAPI{
+		Token:       getEnv("GANTED_ADMIN_TOKEN", ""),
+		Server:      server,
+		Credentials: credentials,
+		Usage:       usage,
+		StartTime:   startTime,
+		Reload: func() error {
+			return reloadConfig(acls, upstreams, rewriter)
+		},
+	}
+	if adminAddr := getEnv("GANTED_ADMIN_LISTEN", ""); adminAddr != "" {
+		if admin.Token == "" {
+			fatal("GANTED_ADMIN_TOKEN is required when GANTED_ADMIN_LISTEN is set")
+		}
+		go func() {
+			if err := admin.ListenAndServe(adminAddr); err != nil {
+				fatal("failed to start admin API", "err", err)
+			}
+		}()
+	}
+	// The control socket needs no token, so it is only opened on request
+	if controlSocket := getEnv("GANTED_CONTROL_SOCKET", ""); controlSocket != "" {
+		go func() {
+			// The control socket is a convenience; keep proxying without it
+			if err := admin.ServeUnix(controlSocket); err != nil {
+				slog.Error("failed to start control socket", "err", err)
+			}
+		}()
+	}
+	for i, l := range listeners {
+		go func(l net.Listener, conf *socks5.ListenerConfig) {
+			if err := server.ServeListener(l, conf); err != nil && err != socks5.ErrServerClosed {
+				fatal("socks5 listener failed", "listener", conf.Name, "err", err)
+			}
+		}(l, listenerConfigs[i])
 	}
+	<-shutdownDone
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/net/context"
+)
+
+func TestRadiusCredentials_Valid(t *testing.T) {
+	secret := []byte("testing123")
+	a, addr := newAccountingServer(t, secret)
+	a.fail.Store("bob")
+	for _, timeout := range []time.Duration{5 * time.Second, 0} {
+		r := &RadiusCredentials{Server: addr, Secret: secret, Timeout: timeout, Cache: RadiusCache{Retention: time.Minute}}
+		if !r.Valid(context.Background(), "alice", "secret") {
+			t.Fatalf("bad: %v: alice rejected", timeout)
+		}
+		if r.Valid(context.Background(), "bob", "secret") {
+			t.Fatalf("bad: %v: bob accepted", timeout)
+		}
+	}
+}
+
+func TestWaitSessions(t *testing.T) {
+	s := newSessionServer(t, &socks5.Config{})
+	transfer(t, s.dial(t, "alice"), 10)
+	if waitSessions(s.Server, 50*time.Millisecond) {
+		t.Fatalf("session still open")
+	}
+	s.Close()
+	if !waitSessions(s.Server, 5*time.Second) {
+		t.Fatalf("bad: %v", s.Sessions())
+	}
+}
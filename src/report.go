@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const reportUsage = `Usage: ganted report [flags]
+
+Summarize the traffic recorded in the access logs (access.log,
+access-*.log and archived-access-*.log[.zst|.gz]) of GANTED_LOG_DIR.
+`
+
+// accessLogEntry is a parsed line of the access log
+type accessLogEntry struct {
+	Time        time.Time
+	Client      string
+	Identity    string
+	Destination string
+	// RealDestination is the address connected to, if the destination
+	// was rewritten
+	RealDestination string
+	BytesIn         int64
+	BytesOut        int64
+	Reason          string
+}
+
+// parseAccessLogLine parses a line written by the socks5 access logger:
+//
+//	[date time] remoteAddr identity time_now request bytes_in bytes_out [close_reason [real_dest]]
+//
+// request is either "ip:port" or "fqdn (ip):port"; close_reason is
+// missing from lines written before it was introduced, and the leading
+// timestamp from lines sent to journald or syslog. real_dest is only
+// written for rewritten destinations. The fields are separated by single
+// spaces: identity is empty for clients that did not authenticate, and
+// may itself contain spaces, so it is everything up to time_now.
+func parseAccessLogLine(line string) (*accessLogEntry, error) {
+	fields := strings.Split(strings.TrimRight(line, "\r\n"), " ")
+	if len(fields) > 1 && logDatePattern.MatchString(fields[0]) {
+		fields = fields[2:]
+	}
+	// client, identity and time_now
+	e := &accessLogEntry{}
+	var err error
+	i := 2
+	for ; i < len(fields); i++ {
+		if e.Time, err = time.Parse(time.RFC3339, fields[i]); err == nil {
+			break
+		}
+	}
+	if i >= len(fields) {
+		return nil, fmt.Errorf("missing time")
+	}
+	e.Client = fields[0]
+	e.Identity = strings.Join(fields[1:i], " ")
+	fields = fields[i+1:]
+
+	// request, then 2 to 4 fields
+	if len(fields) > 1 && strings.HasPrefix(fields[1], "(") {
+		// "fqdn (ip):port", keep the name and the port
+		_, port, _ := strings.Cut(fields[1], "):")
+		e.Destination = fields[0] + ":" + port
+		fields = fields[2:]
+	} else if len(fields) > 0 {
+		e.Destination = fields[0]
+		fields = fields[1:]
+	}
+	if len(fields) < 2 || len(fields) > 4 {
+		return nil, fmt.Errorf("unexpected number of fields")
+	}
+	if e.BytesIn, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return nil, fmt.Errorf("bytes in: %w", err)
+	}
+	if e.BytesOut, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("bytes out: %w", err)
+	}
+	if len(fields) > 2 {
+		e.Reason = fields[2]
+	}
+	if len(fields) > 3 {
+		e.RealDestination = fields[3]
+	}
+	return e, nil
+}
+
+// logDatePattern matches the date written by log.LstdFlags
+var logDatePattern = regexp.MustCompile(`^\d{4}/\d{2}/\d{2}$`)
+
+// readAccessLog calls fn for every well-formed line of a plain, zstd or
+// gzip-compressed access log
+func readAccessLog(filePath string, fn func(*accessLogEntry)) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := decompressor(filePath, file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		entry, err := parseAccessLogLine(scanner.Text())
+		if err != nil {
+			continue
+		}
+		fn(entry)
+	}
+	return scanner.Err()
+}
+
+// reportRow holds the totals of one group of a report
+type reportRow struct {
+	Key      []string
+	Sessions int64
+	BytesIn  int64
+	BytesOut int64
+	Total    int64
+}
+
+// reportKeys extract the grouping columns of a report from an entry
+var reportKeys = map[string]func(*accessLogEntry) string{
+	"user": func(e *accessLogEntry) string { return e.Identity },
+	"dest": func(e *accessLogEntry) string { return e.Destination },
+	"hour": func(e *accessLogEntry) string { return e.Time.Local().Format("2006-01-02 15:00") },
+	"day":  func(e *accessLogEntry) string { return e.Time.Local().Format("2006-01-02") },
+}
+
+// report runs the report command and returns the exit status
+func report(args []string) int {
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	logDir := flags.String("dir", getEnv("GANTED_LOG_DIR", "/var/log/ganted"), "log directory")
+	from := flags.String("from", "", "first day to include (YYYY-MM-DD)")
+	to := flags.String("to", "", "last day to include (YYYY-MM-DD)")
+	by := flags.String("by", "user", "comma-separated columns to group by: user, dest, hour, day")
+	format := flags.String("format", "table", "output format: table, csv or json")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), reportUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return 2
+	}
+
+	fail := func(err error) int {
+		fmt.Fprintf(os.Stderr, "ganted report: %s\n", err)
+		return 1
+	}
+	var start, end time.Time
+	if *from != "" {
+		t, err := time.ParseInLocation("2006-01-02", *from, time.Local)
+		if err != nil {
+			return fail(err)
+		}
+		start = t
+	}
+	if *to != "" {
+		t, err := time.ParseInLocation("2006-01-02", *to, time.Local)
+		if err != nil {
+			return fail(err)
+		}
+		end = t.AddDate(0, 0, 1)
+	}
+	columns := strings.Split(*by, ",")
+	for _, c := range columns {
+		if reportKeys[c] == nil {
+			return fail(fmt.Errorf("unknown column %q", c))
+		}
+	}
+
+	logPattern := regexp.MustCompile(`^(access(-\d{14}(-\d+)?)?\.log|archived-access-\d{8}(\d{6})?(-\d+)?\.log(\.zst|\.gz)?)$`)
+	logFiles, err := findLogs(*logDir, logPattern)
+	if err != nil {
+		return fail(err)
+	}
+	rows := make(map[string]*reportRow)
+	for _, logFile := range logFiles {
+		err := readAccessLog(logFile, func(e *accessLogEntry) {
+			if (!start.IsZero() && e.Time.Before(start)) || (!end.IsZero() && !e.Time.Before(end)) {
+				return
+			}
+			key := make([]string, len(columns))
+			for i, c := range columns {
+				key[i] = reportKeys[c](e)
+			}
+			id := strings.Join(key, "\x00")
+			row, ok := rows[id]
+			if !ok {
+				row = &reportRow{Key: key}
+				rows[id] = row
+			}
+			row.Sessions++
+			row.BytesIn += e.BytesIn
+			row.BytesOut += e.BytesOut
+			row.Total += e.BytesIn + e.BytesOut
+		})
+		if err != nil {
+			return fail(fmt.Errorf("%s: %w", logFile, err))
+		}
+	}
+
+	sorted := make([]*reportRow, 0, len(rows))
+	for _, row := range rows {
+		sorted = append(sorted, row)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return strings.Join(sorted[i].Key, "\x00") < strings.Join(sorted[j].Key, "\x00")
+	})
+
+	if err := writeReport(os.Stdout, *format, columns, sorted); err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+func writeReport(w io.Writer, format string, columns []string, rows []*reportRow) error {
+	header := append(append([]string{}, columns...), "sessions", "bytes_in", "bytes_out", "total")
+	record := func(row *reportRow) []string {
+		return append(append([]string{}, row.Key...),
+			strconv.FormatInt(row.Sessions, 10),
+			strconv.FormatInt(row.BytesIn, 10),
+			strconv.FormatInt(row.BytesOut, 10),
+			strconv.FormatInt(row.Total, 10),
+		)
+	}
+	switch format {
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(header, "\t"))+"\t")
+		for _, row := range rows {
+			fmt.Fprintln(tw, strings.Join(record(row), "\t")+"\t")
+		}
+		return tw.Flush()
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(header)
+		for _, row := range rows {
+			cw.Write(record(row))
+		}
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		out := make([]map[string]interface{}, 0, len(rows))
+		for _, row := range rows {
+			m := map[string]interface{}{
+				"sessions":  row.Sessions,
+				"bytes_in":  row.BytesIn,
+				"bytes_out": row.BytesOut,
+				"total":     row.Total,
+			}
+			for i, c := range columns {
+				m[c] = row.Key[i]
+			}
+			out = append(out, m)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
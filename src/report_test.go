@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// accessLogLine formats a line as the socks5 access logger does, to a
+// logger with the flags of initFileLogger
+func accessLogLine(client, user string, dest *socks5.AddrSpec, in, out int64, reason, realDest string) string {
+	if realDest != "" {
+		realDest = " " + realDest
+	}
+	var buf bytes.Buffer
+	log.New(&buf, "", log.LstdFlags).Printf("%s %s %s %s %d %d %s%s",
+		client, user, "2026-01-02T03:04:05Z", dest.String(), in, out, reason, realDest)
+	return buf.String()
+}
+
+func TestParseAccessLogLine(t *testing.T) {
+	when := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	ipv4 := &socks5.AddrSpec{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	ipv6 := &socks5.AddrSpec{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	fqdn := &socks5.AddrSpec{FQDN: "example.com", IP: net.ParseIP("203.0.113.5"), Port: 443}
+	for _, c := range []struct {
+		name string
+		line string
+		want accessLogEntry
+	}{
+		{
+			"user",
+			accessLogLine("192.0.2.7:40000", "alice", ipv4, 10, 20, "closed", ""),
+			accessLogEntry{when, "192.0.2.7:40000", "alice", "198.51.100.1:443", "", 10, 20, "closed"},
+		},
+		{
+			"without date, as sent to journald or syslog",
+			"192.0.2.7:40000 alice 2026-01-02T03:04:05Z 198.51.100.1:443 10 20 closed",
+			accessLogEntry{when, "192.0.2.7:40000", "alice", "198.51.100.1:443", "", 10, 20, "closed"},
+		},
+		{
+			"without date or auth",
+			"192.0.2.7:40000  2026-01-02T03:04:05Z 198.51.100.1:443 10 20 closed",
+			accessLogEntry{when, "192.0.2.7:40000", "", "198.51.100.1:443", "", 10, 20, "closed"},
+		},
+		{
+			"no auth",
+			accessLogLine("192.0.2.7:40000", "", ipv4, 10, 20, "error", ""),
+			accessLogEntry{when, "192.0.2.7:40000", "", "198.51.100.1:443", "", 10, 20, "error"},
+		},
+		{
+			"ipv6 client without auth",
+			accessLogLine("[2001:db8::7]:40000", "", ipv4, 10, 20, "closed", ""),
+			accessLogEntry{when, "[2001:db8::7]:40000", "", "198.51.100.1:443", "", 10, 20, "closed"},
+		},
+		{
+			"ipv6 destination",
+			accessLogLine("[2001:db8::7]:40000", "alice", ipv6, 10, 20, "closed", ""),
+			accessLogEntry{when, "[2001:db8::7]:40000", "alice", "[2001:db8::1]:443", "", 10, 20, "closed"},
+		},
+		{
+			"fqdn",
+			accessLogLine("192.0.2.7:40000", "alice", fqdn, 1234, 5678, "idle-timeout", ""),
+			accessLogEntry{when, "192.0.2.7:40000", "alice", "example.com:443", "", 1234, 5678, "idle-timeout"},
+		},
+		{
+			"no auth fqdn",
+			accessLogLine("192.0.2.7:40000", "", fqdn, 1, 2, "killed", ""),
+			accessLogEntry{when, "192.0.2.7:40000", "", "example.com:443", "", 1, 2, "killed"},
+		},
+		{
+			"rewritten",
+			accessLogLine("192.0.2.7:40000", "alice", fqdn, 1, 2, "closed", "10.0.0.1:8443"),
+			accessLogEntry{when, "192.0.2.7:40000", "alice", "example.com:443", "10.0.0.1:8443", 1, 2, "closed"},
+		},
+		{
+			"name rewritten before it was resolved",
+			accessLogLine("192.0.2.7:40000", "alice", &socks5.AddrSpec{FQDN: "example.com", Port: 443}, 1, 2, "closed", "10.0.0.1:8443"),
+			accessLogEntry{when, "192.0.2.7:40000", "alice", "example.com:443", "10.0.0.1:8443", 1, 2, "closed"},
+		},
+		{
+			"no auth rewritten",
+			accessLogLine("192.0.2.7:40000", "", ipv4, 1, 2, "killed", "[2001:db8::9]:443"),
+			accessLogEntry{when, "192.0.2.7:40000", "", "198.51.100.1:443", "[2001:db8::9]:443", 1, 2, "killed"},
+		},
+		{
+			"no auth fqdn rewritten",
+			accessLogLine("192.0.2.7:40000", "", fqdn, 1, 2, "closed", "10.0.0.1:8443"),
+			accessLogEntry{when, "192.0.2.7:40000", "", "example.com:443", "10.0.0.1:8443", 1, 2, "closed"},
+		},
+		{
+			"user with spaces",
+			accessLogLine("192.0.2.7:40000", "Alice Smith", ipv4, 10, 20, "closed", ""),
+			accessLogEntry{when, "192.0.2.7:40000", "Alice Smith", "198.51.100.1:443", "", 10, 20, "closed"},
+		},
+		{
+			"without close reason",
+			"2026/01/02 03:04:06 192.0.2.7:40000 alice 2026-01-02T03:04:05Z 198.51.100.1:443 10 20",
+			accessLogEntry{when, "192.0.2.7:40000", "alice", "198.51.100.1:443", "", 10, 20, ""},
+		},
+	} {
+		e, err := parseAccessLogLine(c.line)
+		if err != nil {
+			t.Fatalf("%s: err: %v", c.name, err)
+		}
+		if !e.Time.Equal(c.want.Time) {
+			t.Fatalf("%s: bad time: %v", c.name, e.Time)
+		}
+		e.Time = c.want.Time
+		if *e != c.want {
+			t.Fatalf("%s: bad: %+v", c.name, *e)
+		}
+	}
+
+	for _, line := range []string{
+		"",
+		"garbage",
+		"2026/01/02 03:04:06 192.0.2.7:40000 alice 198.51.100.1:443 10 20 closed",
+		"2026/01/02 03:04:06 192.0.2.7:40000 alice 2026-01-02T03:04:05Z 198.51.100.1:443 10",
+		"2026/01/02 03:04:06 192.0.2.7:40000 alice 2026-01-02T03:04:05Z 198.51.100.1:443 ten 20 closed",
+		"2026/01/02 03:04:06 192.0.2.7:40000 alice 2026-01-02T03:04:05Z 198.51.100.1:443 10 20 closed 10.0.0.1:8443 extra",
+	} {
+		if _, err := parseAccessLogLine(line); err == nil {
+			t.Fatalf("parsed %q", line)
+		}
+	}
+}
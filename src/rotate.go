@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// RotationPolicy configures when a log file is rotated, how the rotated
+// files are archived and how long the archives are kept
+type RotationPolicy struct {
+	// Period rotates the log whenever the clock crosses a multiple of it
+	// (hourly rotation happens on the hour). Zero disables time-based rotation.
+	Period time.Duration
+	// MaxSize rotates the log once it grows beyond this many bytes.
+	// Zero disables size-based rotation.
+	MaxSize int64
+	// ArchiveAfter is the number of rotated files that are concatenated
+	// into one compressed archive
+	ArchiveAfter int
+	// Compression is "zstd", "gzip" or "none"
+	Compression string
+	// CompressionLevel is 1-4 for zstd and 1-9 for gzip, zero for the default
+	CompressionLevel int
+	// MaxAge deletes archives older than this. Zero keeps them forever.
+	MaxAge time.Duration
+	// MaxTotalSize deletes the oldest archives until the rest fit in this
+	// many bytes. Zero disables the limit.
+	MaxTotalSize int64
+}
+
+// compressionExt returns the file extension of the configured compression
+func (p *RotationPolicy) compressionExt() (string, error) {
+	switch p.Compression {
+	case "zstd":
+		return ".zst", nil
+	case "gzip":
+		return ".gz", nil
+	case "none":
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown compression %q", p.Compression)
+}
+
+// compressor wraps w in a writer for the configured compression
+func (p *RotationPolicy) compressor(w io.Writer) (io.WriteCloser, error) {
+	switch p.Compression {
+	case "zstd":
+		level := zstd.SpeedDefault
+		if p.CompressionLevel > 0 {
+			level = zstd.EncoderLevel(p.CompressionLevel)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+	case "gzip":
+		level := gzip.DefaultCompression
+		if p.CompressionLevel > 0 {
+			level = p.CompressionLevel
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "none":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", p.Compression)
+}
+
+// decompressor wraps r, the content of the file at path, in a reader
+// for the compression indicated by its extension
+func decompressor(path string, r io.Reader) (io.ReadCloser, error) {
+	switch filepath.Ext(path) {
+	case ".zst":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case ".gz":
+		return gzip.NewReader(r)
+	}
+	return io.NopCloser(r), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// parseSize parses a byte count with an optional K, M, G or T suffix
+// (powers of 1024)
+func parseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	shift := 0
+	if s != "" {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			shift = 10 * (i + 1)
+			s = strings.TrimSpace(s[:len(s)-1])
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n << shift, nil
+}
+
+// uniquePath returns base+ext, or base-N+ext for the smallest N that
+// doesn't exist yet with any of the given extensions
+func uniquePath(base string, exts ...string) string {
+	for n := 0; ; n++ {
+		candidate := base
+		if n > 0 {
+			candidate = fmt.Sprintf("%s-%d", base, n)
+		}
+		taken := false
+		for _, ext := range exts {
+			if _, err := os.Lstat(candidate + ext); !errors.Is(err, os.ErrNotExist) {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			return candidate
+		}
+	}
+}
+
+// LogRotator rotates the file written by Logger according to Policy.
+// Rotated files are named <name>-<datetime>.log and archived as
+// archived-<name>-<datetime>.log.<ext> next to the log file.
+type LogRotator struct {
+	Logger *log.Logger
+	Path   string
+	Policy RotationPolicy
+
+	mu           sync.Mutex
+	lastRotation time.Time
+}
+
+// name returns the name of the log without directory and extension,
+// e.g. "access" for /var/log/ganted/access.log
+func (r *LogRotator) name() string {
+	return strings.TrimSuffix(filepath.Base(r.Path), filepath.Ext(r.Path))
+}
+
+// rotatedPattern matches the rotated, not yet archived files
+func (r *LogRotator) rotatedPattern() *regexp.Regexp {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(r.name()) + `-\d{14}(-\d+)?\.log$`)
+}
+
+// archivePattern matches the archives, including the daily ones
+// written by earlier versions
+func (r *LogRotator) archivePattern() *regexp.Regexp {
+	return regexp.MustCompile(`^archived-` + regexp.QuoteMeta(r.name()) + `-\d{8}(\d{6})?(-\d+)?\.log(\.zst|\.gz)?$`)
+}
+
+// Run checks every interval whether the log is due for rotation, and
+// logs failures
+func (r *LogRotator) Run(interval time.Duration) {
+	r.mu.Lock()
+	r.lastRotation = time.Now()
+	r.mu.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if !r.due(now) {
+			continue
+		}
+		if err := r.Rotate(); err != nil {
+			slog.Error("log rotation error", "path", r.Path, "err", err)
+		}
+	}
+}
+
+// due reports whether the log should be rotated now
+func (r *LogRotator) due(now time.Time) bool {
+	r.mu.Lock()
+	last := r.lastRotation
+	r.mu.Unlock()
+	if r.Policy.Period > 0 && now.Truncate(r.Policy.Period).After(last.Truncate(r.Policy.Period)) {
+		return true
+	}
+	if r.Policy.MaxSize > 0 {
+		if fi, err := os.Stat(r.Path); err == nil && fi.Size() >= r.Policy.MaxSize {
+			return true
+		}
+	}
+	return false
+}
+
+// Rotate renames the log to <name>-<datetime>.log and reopens it, then
+// archives the rotated files and applies the retention policy
+func (r *LogRotator) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.lastRotation = now
+
+	// Don't leave empty files behind
+	if fi, err := os.Stat(r.Path); err != nil || fi.Size() == 0 {
+		return err
+	}
+	ext := filepath.Ext(r.Path)
+	base := strings.TrimSuffix(r.Path, ext) + "-" + now.Format("20060102150405")
+	if err := os.Rename(r.Path, uniquePath(base, ext)+ext); err != nil {
+		return err
+	}
+	// ask the logger to reopen the log file
+	if err := setFileLoggerOutput(r.Logger, r.Path); err != nil {
+		return err
+	}
+	if err := r.archive(); err != nil {
+		return err
+	}
+	return r.applyRetention(now)
+}
+
+const (
+	// suffix of an archive that is still being written
+	archiveTempSuffix = ".tmp"
+	// suffix of the list of rotated files an archive replaces
+	archiveManifestSuffix = ".sources"
+)
+
+// archive concatenates the rotated files into a compressed archive once
+// there are Policy.ArchiveAfter of them.
+//
+// The archive is written to a temporary file, synced, verified and then
+// atomically renamed into place. Its sources are listed in a manifest
+// until they have been removed, so Recover can finish or roll back an
+// archive interrupted by a crash without losing or duplicating logs.
+func (r *LogRotator) archive() error {
+	logDir := filepath.Dir(r.Path)
+	logFiles, err := findLogs(logDir, r.rotatedPattern())
+	if err != nil {
+		return err
+	}
+	if len(logFiles) == 0 || len(logFiles) < r.Policy.ArchiveAfter {
+		return nil
+	}
+	// oldest first, name-N.log being rotated after name.log
+	sort.Slice(logFiles, func(i, j int) bool {
+		return strings.TrimSuffix(logFiles[i], ".log") < strings.TrimSuffix(logFiles[j], ".log")
+	})
+	ext, err := r.Policy.compressionExt()
+	if err != nil {
+		return err
+	}
+	archivePath := uniquePath(
+		filepath.Join(logDir, "archived-"+r.name()+"-"+time.Now().Format("20060102150405")),
+		".log"+ext, ".log"+ext+archiveTempSuffix, ".log"+ext+archiveManifestSuffix,
+	) + ".log" + ext
+	tempPath := archivePath + archiveTempSuffix
+	manifestPath := archivePath + archiveManifestSuffix
+
+	// Record the sources before touching anything else
+	var manifest strings.Builder
+	for _, logFile := range logFiles {
+		manifest.WriteString(filepath.Base(logFile) + "\n")
+	}
+	if err := writeFileSync(manifestPath, []byte(manifest.String())); err != nil {
+		os.Remove(manifestPath)
+		return err
+	}
+	// and make sure the manifest itself survives a crash before the
+	// archive can
+	if err := syncDir(logDir); err != nil {
+		os.Remove(manifestPath)
+		return err
+	}
+
+	sum, err := r.writeArchive(tempPath, logFiles)
+	if err == nil {
+		err = verifyArchive(tempPath, sum)
+	}
+	if err == nil {
+		err = os.Rename(tempPath, archivePath)
+	}
+	if err == nil {
+		err = syncDir(logDir)
+	}
+	if err != nil {
+		// roll back; the sources are untouched
+		os.Remove(tempPath)
+		os.Remove(manifestPath)
+		return err
+	}
+	return finishArchive(archivePath)
+}
+
+// writeArchive compresses the concatenation of logFiles into path and
+// returns the SHA-256 of the uncompressed data
+func (r *LogRotator) writeArchive(path string, logFiles []string) ([]byte, error) {
+	archiveFile, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer archiveFile.Close()
+	zw, err := r.Policy.compressor(archiveFile)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	w := io.MultiWriter(zw, hash)
+	for _, logFile := range logFiles {
+		if err := appendFile(w, logFile); err != nil {
+			return nil, err
+		}
+	}
+	// flush the compressing writer and make sure it's on disk
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if err := archiveFile.Sync(); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), archiveFile.Close()
+}
+
+// appendFile copies the content of the file at path to w
+func appendFile(w io.Writer, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(w, src)
+	return err
+}
+
+// verifyArchive decompresses the archive at path and checks that it
+// holds exactly the data with the given SHA-256
+func verifyArchive(path string, sum []byte) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	rd, err := decompressor(strings.TrimSuffix(path, archiveTempSuffix), file)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, rd); err != nil {
+		return fmt.Errorf("verify %s: %w", path, err)
+	}
+	if !bytes.Equal(hash.Sum(nil), sum) {
+		return fmt.Errorf("verify %s: content mismatch", path)
+	}
+	return nil
+}
+
+// finishArchive removes the sources listed in the manifest of a
+// complete archive, then the manifest itself
+func finishArchive(archivePath string) error {
+	manifestPath := archivePath + archiveManifestSuffix
+	manifest, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	logDir := filepath.Dir(archivePath)
+	for _, name := range strings.Fields(string(manifest)) {
+		logFile := filepath.Join(logDir, filepath.Base(name))
+		if err := os.Remove(logFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("err when removing file %s: %w", logFile, err)
+		}
+	}
+	if err := syncDir(logDir); err != nil {
+		return err
+	}
+	return os.Remove(manifestPath)
+}
+
+// Recover cleans up after archiving was interrupted, e.g. by a crash:
+// an archive that made it into place gets its sources removed, while
+// a partial one is discarded and its sources are archived again later.
+func (r *LogRotator) Recover() error {
+	logDir := filepath.Dir(r.Path)
+	leftoverPattern := regexp.MustCompile(`^archived-` + regexp.QuoteMeta(r.name()) +
+		`-\d{14}(-\d+)?\.log(\.zst|\.gz)?(` + regexp.QuoteMeta(archiveTempSuffix) + `|` + regexp.QuoteMeta(archiveManifestSuffix) + `)$`)
+	leftovers, err := findLogs(logDir, leftoverPattern)
+	if err != nil {
+		return err
+	}
+	for _, path := range leftovers {
+		if archivePath, ok := strings.CutSuffix(path, archiveManifestSuffix); ok {
+			if _, err := os.Stat(archivePath); err == nil {
+				// the archive was verified before it was renamed into place
+				slog.Info("finishing interrupted archive", "path", archivePath)
+				if err := finishArchive(archivePath); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		slog.Info("removing partial archive", "path", path)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileSync writes data to a new file and syncs it to disk
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir makes renames and removals in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// applyRetention deletes archives older than Policy.MaxAge, then the
+// oldest ones until the rest fit in Policy.MaxTotalSize
+func (r *LogRotator) applyRetention(now time.Time) error {
+	if r.Policy.MaxAge <= 0 && r.Policy.MaxTotalSize <= 0 {
+		return nil
+	}
+	archives, err := findLogs(filepath.Dir(r.Path), r.archivePattern())
+	if err != nil {
+		return err
+	}
+	type archive struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var list []archive
+	var total int64
+	for _, path := range archives {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		list = append(list, archive{path, fi.Size(), fi.ModTime()})
+		total += fi.Size()
+	}
+	// oldest first
+	sort.Slice(list, func(i, j int) bool { return list[i].modTime.Before(list[j].modTime) })
+	for _, a := range list {
+		expired := r.Policy.MaxAge > 0 && now.Sub(a.modTime) > r.Policy.MaxAge
+		oversized := r.Policy.MaxTotalSize > 0 && total > r.Policy.MaxTotalSize
+		if !expired && !oversized {
+			break
+		}
+		if err := os.Remove(a.path); err != nil {
+			return err
+		}
+		slog.Info("removed archived log", "path", a.path)
+		total -= a.size
+	}
+	return nil
+}
+
+func findLogs(logDir string, logPattern *regexp.Regexp) ([]string, error) {
+	var logFiles []string
+	err := filepath.WalkDir(logDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && logPattern.MatchString(d.Name()) {
+			logFiles = append(logFiles, path)
+		}
+		return nil
+	})
+	return logFiles, err
+}
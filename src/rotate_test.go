@@ -0,0 +1,436 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLogs creates the files of logs, by name, in dir
+func writeLogs(t *testing.T, dir string, logs map[string]string) {
+	for name, content := range logs {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+// readArchive returns the uncompressed content of the archive at path
+func readArchive(t *testing.T, path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer file.Close()
+	rd, err := decompressor(path, file)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return string(data)
+}
+
+// exists tells if path exists
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+var rotatedLogs = map[string]string{
+	"access-20260101000000.log": "first\n",
+	"access-20260101010000.log": "second\n",
+}
+
+const (
+	rotatedManifest = "access-20260101000000.log\naccess-20260101010000.log\n"
+	rotatedContent  = "first\nsecond\n"
+)
+
+func TestVerifyArchive(t *testing.T) {
+	dir := t.TempDir()
+	writeLogs(t, dir, rotatedLogs)
+	sources := []string{filepath.Join(dir, "access-20260101000000.log"), filepath.Join(dir, "access-20260101010000.log")}
+	for _, compression := range []string{"zstd", "gzip", "none"} {
+		r := &LogRotator{Path: filepath.Join(dir, "access.log"), Policy: RotationPolicy{Compression: compression}}
+		ext, _ := r.Policy.compressionExt()
+		path := filepath.Join(dir, "archived-access-20260101020000.log"+ext+archiveTempSuffix)
+		sum, err := r.writeArchive(path, sources)
+		if err != nil {
+			t.Fatalf("%s: err: %v", compression, err)
+		}
+		if err := verifyArchive(path, sum); err != nil {
+			t.Fatalf("%s: err: %v", compression, err)
+		}
+		if err := verifyArchive(path, make([]byte, len(sum))); err == nil {
+			t.Fatalf("%s: verified with the wrong sum", compression)
+		}
+
+		// a partial archive does not verify
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := os.Truncate(path, fi.Size()-4); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := verifyArchive(path, sum); err == nil {
+			t.Fatalf("%s: verified a truncated archive", compression)
+		}
+		os.Remove(path)
+	}
+}
+
+func TestFinishArchive(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	writeLogs(t, dir, rotatedLogs)
+	writeLogs(t, outside, map[string]string{"kept.log": "kept\n"})
+	archivePath := filepath.Join(dir, "archived-access-20260101020000.log")
+	writeLogs(t, dir, map[string]string{filepath.Base(archivePath): rotatedContent})
+
+	// no manifest, nothing to remove
+	if err := finishArchive(archivePath); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// sources are only removed from the log directory, and those already
+	// gone are skipped
+	manifest := rotatedManifest + "missing.log\n" + filepath.Join(outside, "kept.log") + "\n"
+	writeLogs(t, dir, map[string]string{filepath.Base(archivePath) + archiveManifestSuffix: manifest})
+	if err := finishArchive(archivePath); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for name := range rotatedLogs {
+		if exists(filepath.Join(dir, name)) {
+			t.Fatalf("%s not removed", name)
+		}
+	}
+	if exists(archivePath + archiveManifestSuffix) {
+		t.Fatalf("manifest not removed")
+	}
+	if !exists(archivePath) || !exists(filepath.Join(outside, "kept.log")) {
+		t.Fatalf("removed too much")
+	}
+}
+
+func TestLogRotator_Recover(t *testing.T) {
+	archiveName := "archived-access-20260101020000.log.zst"
+	for _, c := range []struct {
+		name string
+		// leftovers of the interrupted archive
+		leftovers map[string]string
+		// archive in place before Recover
+		archived bool
+		// the sources removed before the interruption
+		removed []string
+		// the sources are expected to be archived again
+		rolledBack bool
+	}{
+		{
+			name:       "manifest only",
+			leftovers:  map[string]string{archiveName + archiveManifestSuffix: rotatedManifest},
+			rolledBack: true,
+		},
+		{
+			name: "partial archive",
+			leftovers: map[string]string{
+				archiveName + archiveManifestSuffix: rotatedManifest,
+				archiveName + archiveTempSuffix:     "partial",
+			},
+			rolledBack: true,
+		},
+		{
+			name:      "archive in place",
+			leftovers: map[string]string{archiveName + archiveManifestSuffix: rotatedManifest},
+			archived:  true,
+		},
+		{
+			name:      "sources partly removed",
+			leftovers: map[string]string{archiveName + archiveManifestSuffix: rotatedManifest},
+			archived:  true,
+			removed:   []string{"access-20260101000000.log"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			r := &LogRotator{Path: filepath.Join(dir, "access.log"), Policy: RotationPolicy{ArchiveAfter: 2, Compression: "zstd"}}
+			writeLogs(t, dir, rotatedLogs)
+			writeLogs(t, dir, c.leftovers)
+			if c.archived {
+				sources := []string{filepath.Join(dir, "access-20260101000000.log"), filepath.Join(dir, "access-20260101010000.log")}
+				if _, err := r.writeArchive(filepath.Join(dir, archiveName), sources); err != nil {
+					t.Fatalf("err: %v", err)
+				}
+			}
+			for _, name := range c.removed {
+				os.Remove(filepath.Join(dir, name))
+			}
+
+			if err := r.Recover(); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			for name := range c.leftovers {
+				if exists(filepath.Join(dir, name)) {
+					t.Fatalf("%s left behind", name)
+				}
+			}
+			if c.rolledBack {
+				for name := range rotatedLogs {
+					if !exists(filepath.Join(dir, name)) {
+						t.Fatalf("%s lost", name)
+					}
+				}
+				if err := r.archive(); err != nil {
+					t.Fatalf("err: %v", err)
+				}
+			}
+
+			// either way, the logs end up archived once
+			archives, err := findLogs(dir, r.archivePattern())
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if len(archives) != 1 {
+				t.Fatalf("bad: %v", archives)
+			}
+			if content := readArchive(t, archives[0]); content != rotatedContent {
+				t.Fatalf("bad: %q", content)
+			}
+			if rotated, _ := findLogs(dir, r.rotatedPattern()); len(rotated) != 0 {
+				t.Fatalf("bad: %v", rotated)
+			}
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				if strings.HasSuffix(e.Name(), archiveTempSuffix) || strings.HasSuffix(e.Name(), archiveManifestSuffix) {
+					t.Fatalf("%s left behind", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"0", 0, false},
+		{"1024", 1024, false},
+		{"10K", 10 << 10, false},
+		{"10kb", 10 << 10, false},
+		{"5M", 5 << 20, false},
+		{" 3 MB ", 3 << 20, false},
+		{"1G", 1 << 30, false},
+		{"2T", 2 << 40, false},
+		{"", 0, true},
+		{"K", 0, true},
+		{"1.5M", 0, true},
+		{"10X", 0, true},
+	} {
+		n, err := parseSize(c.in)
+		if (err != nil) != c.err || n != c.want {
+			t.Fatalf("bad: %q: %d %v", c.in, n, err)
+		}
+	}
+}
+
+func TestUniquePath(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "archived-access-20260101000000")
+	if path := uniquePath(base, ".log", ".log.zst"); path != base {
+		t.Fatalf("bad: %s", path)
+	}
+	writeLogs(t, dir, map[string]string{"archived-access-20260101000000.log": ""})
+	if path := uniquePath(base, ".log", ".log.zst"); path != base+"-1" {
+		t.Fatalf("bad: %s", path)
+	}
+	// any of the extensions takes the name
+	writeLogs(t, dir, map[string]string{"archived-access-20260101000000-1.log.zst": ""})
+	if path := uniquePath(base, ".log", ".log.zst"); path != base+"-2" {
+		t.Fatalf("bad: %s", path)
+	}
+}
+
+func TestLogRotator_Due(t *testing.T) {
+	dir := t.TempDir()
+	writeLogs(t, dir, map[string]string{"access.log": "0123456789"})
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return tm
+	}
+	for _, c := range []struct {
+		name   string
+		policy RotationPolicy
+		last   string
+		now    string
+		due    bool
+	}{
+		{"hour crossed", RotationPolicy{Period: time.Hour}, "2026-01-01T10:59:59Z", "2026-01-01T11:00:00Z", true},
+		{"same hour", RotationPolicy{Period: time.Hour}, "2026-01-01T11:00:00Z", "2026-01-01T11:59:59Z", false},
+		{"hours later", RotationPolicy{Period: time.Hour}, "2026-01-01T10:30:00Z", "2026-01-01T13:10:00Z", true},
+		{"day crossed", RotationPolicy{Period: 24 * time.Hour}, "2026-01-01T23:59:00Z", "2026-01-02T00:01:00Z", true},
+		{"same day", RotationPolicy{Period: 24 * time.Hour}, "2026-01-01T00:00:00Z", "2026-01-01T23:59:59Z", false},
+		{"no period", RotationPolicy{}, "2026-01-01T00:00:00Z", "2026-02-01T00:00:00Z", false},
+		{"size reached", RotationPolicy{MaxSize: 10}, "2026-01-01T00:00:00Z", "2026-01-01T00:00:01Z", true},
+		{"size below", RotationPolicy{MaxSize: 11}, "2026-01-01T00:00:00Z", "2026-01-01T00:00:01Z", false},
+	} {
+		r := &LogRotator{Path: filepath.Join(dir, "access.log"), Policy: c.policy, lastRotation: at(c.last)}
+		if due := r.due(at(c.now)); due != c.due {
+			t.Fatalf("bad: %s: %v", c.name, due)
+		}
+	}
+	r := &LogRotator{Path: filepath.Join(dir, "missing.log"), Policy: RotationPolicy{MaxSize: 1}}
+	if r.due(time.Now()) {
+		t.Fatalf("missing log due")
+	}
+}
+
+func TestLogRotator_ApplyRetention(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		name   string
+		policy RotationPolicy
+		kept   []string
+	}{
+		{"keep all", RotationPolicy{}, []string{"old", "older", "recent"}},
+		{"max age", RotationPolicy{MaxAge: 7 * 24 * time.Hour}, []string{"old", "recent"}},
+		{"max total size", RotationPolicy{MaxTotalSize: 250}, []string{"old", "recent"}},
+		{"both", RotationPolicy{MaxAge: 7 * 24 * time.Hour, MaxTotalSize: 150}, []string{"recent"}},
+	} {
+		dir := t.TempDir()
+		archives := map[string]string{
+			"older":  "archived-access-20260101000000.log.zst",
+			"old":    "archived-access-20260108.log.gz",
+			"recent": "archived-access-20260110000000-1.log",
+		}
+		ages := map[string]time.Duration{"older": 10 * 24 * time.Hour, "old": 2 * 24 * time.Hour, "recent": time.Hour}
+		for key, name := range archives {
+			writeLogs(t, dir, map[string]string{name: strings.Repeat("x", 100)})
+			mtime := now.Add(-ages[key])
+			if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		// only archives of this log are subject to retention
+		others := map[string]string{
+			"access-20260101000000.log":                  "rotated",
+			"archived-error-20260101000000.log.zst":      "other log",
+			"archived-access-20260101000000.log.zst.tmp": "partial",
+		}
+		writeLogs(t, dir, others)
+		for name := range others {
+			old := now.Add(-30 * 24 * time.Hour)
+			os.Chtimes(filepath.Join(dir, name), old, old)
+		}
+
+		r := &LogRotator{Path: filepath.Join(dir, "access.log"), Policy: c.policy}
+		if err := r.applyRetention(now); err != nil {
+			t.Fatalf("%s: err: %v", c.name, err)
+		}
+		var kept []string
+		for _, key := range []string{"old", "older", "recent"} {
+			if exists(filepath.Join(dir, archives[key])) {
+				kept = append(kept, key)
+			}
+		}
+		if strings.Join(kept, ",") != strings.Join(c.kept, ",") {
+			t.Fatalf("bad: %s: %v", c.name, kept)
+		}
+		for name := range others {
+			if !exists(filepath.Join(dir, name)) {
+				t.Fatalf("%s: %s removed", c.name, name)
+			}
+		}
+	}
+}
+
+// newTestRotator returns a rotator of access.log in a new directory,
+// written by its Logger
+func newTestRotator(t *testing.T, policy RotationPolicy) *LogRotator {
+	r := &LogRotator{
+		Logger: log.New(io.Discard, "", 0),
+		Path:   filepath.Join(t.TempDir(), "access.log"),
+		Policy: policy,
+	}
+	if err := setFileLoggerOutput(r.Logger, r.Path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { r.Logger.Writer().(io.Closer).Close() })
+	return r
+}
+
+func TestLogRotator_Rotate(t *testing.T) {
+	for _, compression := range []string{"zstd", "gzip", "none"} {
+		r := newTestRotator(t, RotationPolicy{ArchiveAfter: 3, Compression: compression})
+		dir := filepath.Dir(r.Path)
+
+		// an empty log is not rotated
+		if err := r.Rotate(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if rotated, _ := findLogs(dir, r.rotatedPattern()); len(rotated) != 0 {
+			t.Fatalf("bad: %v", rotated)
+		}
+
+		// rotations within the same second are archived in order
+		var want strings.Builder
+		for i := 0; i < 3; i++ {
+			line := fmt.Sprintf("line %d", i)
+			r.Logger.Println(line)
+			want.WriteString(line + "\n")
+			if err := r.Rotate(); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		archives, err := findLogs(dir, r.archivePattern())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(archives) != 1 {
+			t.Fatalf("%s: bad: %v", compression, archives)
+		}
+		if content := readArchive(t, archives[0]); content != want.String() {
+			t.Fatalf("%s: bad: %q", compression, content)
+		}
+		if rotated, _ := findLogs(dir, r.rotatedPattern()); len(rotated) != 0 {
+			t.Fatalf("%s: bad: %v", compression, rotated)
+		}
+
+		// the logger writes to the reopened log
+		r.Logger.Println("after")
+		if data, _ := os.ReadFile(r.Path); string(data) != "after\n" {
+			t.Fatalf("%s: bad: %q", compression, data)
+		}
+	}
+}
+
+func TestLogRotator_Run(t *testing.T) {
+	r := newTestRotator(t, RotationPolicy{MaxSize: 10, ArchiveAfter: 2, Compression: "none"})
+	go r.Run(10 * time.Millisecond)
+	r.Logger.Println("below")
+	time.Sleep(50 * time.Millisecond)
+	if rotated, _ := findLogs(filepath.Dir(r.Path), r.rotatedPattern()); len(rotated) != 0 {
+		t.Fatalf("rotated below MaxSize: %v", rotated)
+	}
+	r.Logger.Println("and beyond")
+	for i := 0; i < 100; i++ {
+		if rotated, _ := findLogs(filepath.Dir(r.Path), r.rotatedPattern()); len(rotated) == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("not rotated")
+}
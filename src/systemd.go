@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd
+const listenFDsStart = 3
+
+// systemdListeners returns the sockets passed by systemd socket
+// activation, by their FileDescriptorName from LISTEN_FDNAMES, or nil if
+// the process was not socket activated. The activation variables are
+// unset so that child processes don't inherit them.
+func systemdListeners() (map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(getEnv("LISTEN_PID", ""))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(getEnv("LISTEN_FDS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %w", err)
+	}
+	names := strings.Split(getEnv("LISTEN_FDNAMES", ""), ":")
+	listeners := make(map[string]net.Listener)
+	for i := 0; i < n; i++ {
+		// systemd names sockets "unknown" unless told otherwise
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		// FileListener works on a duplicate, close the inherited
+		// descriptor
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %s from systemd: %w", name, err)
+		}
+		if _, ok := listeners[name]; ok {
+			return nil, fmt.Errorf("several sockets named %s from systemd, set FileDescriptorName", name)
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// newTLSConfigFromEnv reads the settings of the SOCKS over TLS listeners:
+// GANTED_TLS_CERT and GANTED_TLS_KEY, reloaded when they change,
+// GANTED_TLS_CLIENT_CA to verify client certificates if given, and
+// GANTED_TLS_ALPN, the comma-separated ALPN protocols to offer
+func newTLSConfigFromEnv() (*tls.Config, error) {
+	certFile, keyFile := getEnv("GANTED_TLS_CERT", ""), getEnv("GANTED_TLS_KEY", "")
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("GANTED_TLS_CERT and GANTED_TLS_KEY are required by TLS listeners")
+	}
+	certs, err := socks5.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	for _, proto := range strings.Split(getEnv("GANTED_TLS_ALPN", socks5.ALPNProtocol), ",") {
+		if proto = strings.TrimSpace(proto); proto != "" {
+			config.NextProtos = append(config.NextProtos, proto)
+		}
+	}
+	if caFile := getEnv("GANTED_TLS_CLIENT_CA", ""); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// alpnFallbacks forwards the TLS connections that negotiated an ALPN
+// protocol other than SOCKS, decrypted, to GANTED_TLS_FALLBACK, e.g. a
+// web server sharing the port
+func alpnFallbacks(config *tls.Config) (map[string]func(net.Conn), error) {
+	addr := getEnv("GANTED_TLS_FALLBACK", "")
+	handlers := make(map[string]func(net.Conn))
+	for _, proto := range config.NextProtos {
+		if proto == socks5.ALPNProtocol {
+			continue
+		}
+		if addr == "" {
+			return nil, fmt.Errorf("GANTED_TLS_FALLBACK is required to offer ALPN protocol %q", proto)
+		}
+		handlers[proto] = func(conn net.Conn) {
+			forwardConn(conn, addr)
+		}
+	}
+	return handlers, nil
+}
+
+// forwardConn relays conn to addr until either side closes
+func forwardConn(conn net.Conn, addr string) {
+	target, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		slog.Warn("TLS fallback unreachable", "addr", addr, "client", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+	defer target.Close()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(target, conn)
+		if tcp, ok := target.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		close(done)
+	}()
+	io.Copy(conn, target)
+	conn.Close()
+	<-done
+}
+
+// newCertAuthenticatorFromEnv returns the client certificate
+// authenticator if GANTED_TLS_CERT_AUTH is enabled, or nil. The user is
+// taken from GANTED_TLS_CERT_IDENTITY (cn, email, dns or uri), and
+// revocation checked against GANTED_TLS_CRL (comma-separated files) and
+// the OCSP responses in GANTED_TLS_OCSP_DIR. With GANTED_TLS_OCSP_STRICT,
+// certificates without a current response are rejected instead of
+// logged.
+func newCertAuthenticatorFromEnv() (*socks5.ClientCertAuthenticator, error) {
+	enabled, err := strconv.ParseBool(getEnv("GANTED_TLS_CERT_AUTH", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid GANTED_TLS_CERT_AUTH: %w", err)
+	}
+	if !enabled {
+		return nil, nil
+	}
+	if getEnv("GANTED_TLS_CLIENT_CA", "") == "" {
+		return nil, fmt.Errorf("GANTED_TLS_CERT_AUTH requires GANTED_TLS_CLIENT_CA")
+	}
+	a := &socks5.ClientCertAuthenticator{
+		Identity: getEnv("GANTED_TLS_CERT_IDENTITY", socks5.IdentityCommonName),
+		OCSPDir:  getEnv("GANTED_TLS_OCSP_DIR", ""),
+	}
+	if a.OCSPRequired, err = strconv.ParseBool(getEnv("GANTED_TLS_OCSP_STRICT", "false")); err != nil {
+		return nil, fmt.Errorf("invalid GANTED_TLS_OCSP_STRICT: %w", err)
+	}
+	if a.OCSPRequired && a.OCSPDir == "" {
+		return nil, fmt.Errorf("GANTED_TLS_OCSP_STRICT requires GANTED_TLS_OCSP_DIR")
+	}
+	switch a.Identity {
+	case socks5.IdentityCommonName, socks5.IdentityEmail, socks5.IdentityDNS, socks5.IdentityURI:
+	default:
+		return nil, fmt.Errorf("unknown GANTED_TLS_CERT_IDENTITY %q, expected cn, email, dns or uri", a.Identity)
+	}
+	for _, path := range strings.Split(getEnv("GANTED_TLS_CRL", ""), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			if _, err := os.Stat(path); err != nil {
+				return nil, err
+			}
+			a.CRLFiles = append(a.CRLFiles, path)
+		}
+	}
+	return a, nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// connectProxy starts an HTTP proxy answering CONNECT with status and
+// counting the connections it accepts. On success it writes "pong" in
+// place of the destination.
+func connectProxy(t *testing.T, status int) (string, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				resp := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1}
+				resp.Write(conn)
+				if status == http.StatusOK {
+					conn.Write([]byte("pong"))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), &accepted
+}
+
+// brokenProxy starts a proxy that drops its connections, counting them
+func brokenProxy(t *testing.T) (string, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+	return l.Addr().String(), &accepted
+}
+
+// newTestRouter routes everything through group g
+func newTestRouter(t *testing.T, group string) *UpstreamRouter {
+	r := &UpstreamRouter{Direct: &net.Dialer{}, RetryAfter: time.Minute}
+	if err := r.Set("g="+group, "", "", "g"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return r
+}
+
+// down tells if u is skipped
+func down(u *upstream) bool {
+	return atomic.LoadInt64(&u.downUntil) > time.Now().UnixNano()
+}
+
+func dialPong(t *testing.T, r *UpstreamRouter) {
+	conn, err := r.DialContext(context.Background(), "tcp", "192.0.2.1:443")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if out, _ := io.ReadAll(conn); string(out) != "pong" {
+		t.Fatalf("bad: %q", out)
+	}
+}
+
+func TestUpstreamRouter_Failover(t *testing.T) {
+	broken, brokenAccepts := brokenProxy(t)
+	good, goodAccepts := connectProxy(t, http.StatusOK)
+	r := newTestRouter(t, "http://"+broken+"|http://"+good)
+	upstreams := r.config.groups["g"]
+
+	dialPong(t, r)
+	if !down(upstreams[0]) || down(upstreams[1]) {
+		t.Fatalf("bad: %v %v", down(upstreams[0]), down(upstreams[1]))
+	}
+	// the broken proxy is skipped until RetryAfter
+	dialPong(t, r)
+	if n := atomic.LoadInt32(brokenAccepts); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	if n := atomic.LoadInt32(goodAccepts); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+	// and retried after
+	atomic.StoreInt64(&upstreams[0].downUntil, time.Now().Add(-time.Second).UnixNano())
+	dialPong(t, r)
+	if n := atomic.LoadInt32(brokenAccepts); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestUpstreamRouter_AllDown(t *testing.T) {
+	good, _ := connectProxy(t, http.StatusOK)
+	r := newTestRouter(t, "http://"+good)
+	u := r.config.groups["g"][0]
+	atomic.StoreInt64(&u.downUntil, time.Now().Add(time.Hour).UnixNano())
+
+	// with nothing left, the group is tried anyway
+	dialPong(t, r)
+	if down(u) {
+		t.Fatalf("still down after a success")
+	}
+
+	broken, _ := brokenProxy(t)
+	r = newTestRouter(t, "http://"+broken)
+	if _, err := r.DialContext(context.Background(), "tcp", "192.0.2.1:443"); err == nil {
+		t.Fatalf("dialed through a broken proxy")
+	}
+	if !down(r.config.groups["g"][0]) {
+		t.Fatalf("broken proxy not marked down")
+	}
+}
+
+func TestUpstreamRouter_DestinationError(t *testing.T) {
+	refusing, _ := connectProxy(t, http.StatusBadGateway)
+	denied, _ := connectProxy(t, http.StatusProxyAuthRequired)
+	socksServer, err := socks5.New(&socks5.Config{
+		Rules:        socks5.PermitNone(),
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		AccessLogger: log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer socksServer.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go socksServer.Serve(l)
+
+	for _, c := range []struct {
+		name string
+		url  string
+		down bool
+	}{
+		{"http refused", "http://" + refusing, false},
+		{"socks refused", "socks5://" + l.Addr().String(), false},
+		{"proxy auth", "http://" + denied, true},
+	} {
+		r := newTestRouter(t, c.url)
+		if _, err := r.DialContext(context.Background(), "tcp", "192.0.2.1:443"); err == nil {
+			t.Fatalf("%s: dial succeeded", c.name)
+		}
+		if down(r.config.groups["g"][0]) != c.down {
+			t.Fatalf("%s: bad down %v", c.name, !c.down)
+		}
+	}
+
+	// the next proxy is still tried
+	good, _ := connectProxy(t, http.StatusOK)
+	r := newTestRouter(t, "http://"+refusing+"|http://"+good)
+	dialPong(t, r)
+	if down(r.config.groups["g"][0]) {
+		t.Fatalf("refusing proxy marked down")
+	}
+}
+
+func TestUpstreamRouter_NAT64Route(t *testing.T) {
+	good, _ := connectProxy(t, http.StatusOK)
+	prefix, err := socks5.ParseNAT64Prefix("64:ff9b::/96")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	r := &UpstreamRouter{Direct: &net.Dialer{}, NAT64Prefix: prefix}
+	if err := r.Set("g=http://"+good, "149.154.160.0/20=g", "", directUpstream); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// a mapped address follows the route of the IPv4 address it embeds
+	if group := r.config.route(context.Background(), "[64:ff9b::959a:a733]:443", prefix); group != "g" {
+		t.Fatalf("bad: %s", group)
+	}
+	if group := r.config.route(context.Background(), "[64:ff9b::c000:201]:443", prefix); group != directUpstream {
+		t.Fatalf("bad: %s", group)
+	}
+}
+
+// recordingDialer records the address of every dial, and connects only
+// to loopback addresses
+type recordingDialer struct {
+	net.Dialer
+	addr string
+}
+
+func (d *recordingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.addr = addr
+	if host, _, _ := net.SplitHostPort(addr); !net.ParseIP(host).IsLoopback() {
+		return nil, errors.New("connection refused")
+	}
+	return d.Dialer.DialContext(ctx, network, addr)
+}
+
+func TestUpstreamRouter_NAT64Dial(t *testing.T) {
+	prefix, err := socks5.ParseNAT64Prefix("64:ff9b::/96")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// a proxy reporting the destination of its CONNECT request
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	targets := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if req, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+				targets <- req.Host
+			}
+			conn.Close()
+		}
+	}()
+	direct := &recordingDialer{}
+	r := &UpstreamRouter{Direct: direct, NAT64Prefix: prefix}
+	if err := r.Set("g=http://"+l.Addr().String(), "149.154.160.0/20=g", "", directUpstream); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// only global IPv4 addresses are reached through NAT64
+	for addr, expected := range map[string]string{
+		"192.0.2.1:443":           "[64:ff9b::c000:201]:443",
+		"10.0.0.1:443":            "10.0.0.1:443",
+		"[64:ff9b::c000:201]:443": "[64:ff9b::c000:201]:443",
+	} {
+		r.DialContext(context.Background(), "tcp", addr)
+		if direct.addr != expected {
+			t.Fatalf("bad: %s: %s", addr, direct.addr)
+		}
+	}
+	// upstream proxies get the IPv4 address
+	r.DialContext(context.Background(), "tcp", "[64:ff9b::959a:a733]:443")
+	select {
+	case target := <-targets:
+		if target != "149.154.167.51:443" {
+			t.Fatalf("bad: %s", target)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no CONNECT request")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/armon/go-socks5"
+)
+
+// UsageAggregator accumulates the bytes transferred per user between
+// accounting runs. Finished sessions are added when they close, and live
+// sessions are accounted incrementally at every snapshot, so long-lived
+// connections are billed in the period their traffic happened.
+type UsageAggregator struct {
+	mu    sync.Mutex
+	usage map[string]int64
+	// bytes of each live session already included in a snapshot
+	accounted map[uint64]int64
+}
+
+func NewUsageAggregator() *UsageAggregator {
+	return &UsageAggregator{
+		usage:     make(map[string]int64),
+		accounted: make(map[uint64]int64),
+	}
+}
+
+func sessionBytes(s *socks5.Session) int64 {
+	return s.ReadBytes() + s.WriteBytes()
+}
+
+// SessionClosed implements the socks5.Config.SessionClosed hook.
+func (u *UsageAggregator) SessionClosed(s *socks5.Session, reason string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.usage[s.Username] += sessionBytes(s) - u.accounted[s.ID]
+	delete(u.accounted, s.ID)
+}
+
+// Snapshot returns the usage since the previous snapshot, including the
+// traffic of the live sessions so far, and resets the counters.
+func (u *UsageAggregator) Snapshot(live func() []*socks5.Session) map[string]int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	// List the live sessions under the lock, so a session closing
+	// concurrently is either seen here or by SessionClosed afterwards
+	for _, s := range live() {
+		n := sessionBytes(s)
+		u.usage[s.Username] += n - u.accounted[s.ID]
+		u.accounted[s.ID] = n
+	}
+	usage := u.usage
+	u.usage = make(map[string]int64)
+	return usage
+}
+
+// Restore adds usage back, e.g. after failing to send it.
+func (u *UsageAggregator) Restore(usage map[string]int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for user, n := range usage {
+		u.usage[user] += n
+	}
+}
+
+// Current returns the usage since the previous snapshot, including the
+// live sessions, without resetting anything.
+func (u *UsageAggregator) Current(live func() []*socks5.Session) map[string]int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	usage := make(map[string]int64, len(u.usage))
+	for user, n := range u.usage {
+		usage[user] = n
+	}
+	for _, s := range live() {
+		usage[s.Username] += sessionBytes(s) - u.accounted[s.ID]
+	}
+	return usage
+}
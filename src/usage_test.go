@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+)
+
+// usageServer is a sessionServer whose sessions are accounted by usage
+type usageServer struct {
+	*sessionServer
+	usage  *UsageAggregator
+	closed chan *socks5.Session
+}
+
+func newUsageServer(t *testing.T) *usageServer {
+	u := &usageServer{usage: NewUsageAggregator(), closed: make(chan *socks5.Session, 10)}
+	u.sessionServer = newSessionServer(t, &socks5.Config{
+		SessionClosed: func(s *socks5.Session, reason string) {
+			u.usage.SessionClosed(s, reason)
+			u.closed <- s
+		},
+	})
+	return u
+}
+
+// settled returns the bytes of the live session of user once the
+// counters caught up with the transfers
+func (u *usageServer) settled(t *testing.T, user string) int64 {
+	last := int64(-1)
+	for i := 0; i < 100; i++ {
+		var n int64
+		for _, s := range u.Sessions() {
+			if s.Username == user {
+				n = sessionBytes(s)
+			}
+		}
+		if n == last {
+			return n
+		}
+		last = n
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("bytes of %s still changing", user)
+	return 0
+}
+
+// close ends conn and returns the final bytes of its session
+func (u *usageServer) close(t *testing.T, conn net.Conn) int64 {
+	conn.Close()
+	select {
+	case s := <-u.closed:
+		return sessionBytes(s)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session not closed")
+		return 0
+	}
+}
+
+func TestUsageAggregator(t *testing.T) {
+	u := newUsageServer(t)
+	alice := u.dial(t, "alice")
+	bob := u.dial(t, "bob")
+	transfer(t, alice, 1000)
+	transfer(t, bob, 100)
+
+	// live sessions are accounted so far
+	aliceBytes, bobBytes := u.settled(t, "alice"), u.settled(t, "bob")
+	if aliceBytes < 2000 || bobBytes < 200 {
+		t.Fatalf("bad: %d %d", aliceBytes, bobBytes)
+	}
+	first := u.usage.Snapshot(u.Sessions)
+	if first["alice"] != aliceBytes || first["bob"] != bobBytes {
+		t.Fatalf("bad: %v", first)
+	}
+
+	// a session closing between snapshots adds only what was not
+	// accounted yet
+	transfer(t, bob, 300)
+	bobBytes = u.close(t, bob)
+	second := u.usage.Snapshot(u.Sessions)
+	if second["bob"] != bobBytes-first["bob"] {
+		t.Fatalf("bad: %v, closed at %d", second, bobBytes)
+	}
+	if second["alice"] != 0 {
+		t.Fatalf("idle session counted again: %v", second)
+	}
+
+	// Current peeks without resetting
+	transfer(t, alice, 500)
+	aliceBytes = u.settled(t, "alice")
+	current := u.usage.Current(u.Sessions)
+	if current["alice"] != aliceBytes-first["alice"] {
+		t.Fatalf("bad: %v", current)
+	}
+	if again := u.usage.Current(u.Sessions); again["alice"] != current["alice"] {
+		t.Fatalf("bad: %v", again)
+	}
+	third := u.usage.Snapshot(u.Sessions)
+	if third["alice"] != current["alice"] {
+		t.Fatalf("bad: %v", third)
+	}
+	if _, ok := third["bob"]; ok {
+		t.Fatalf("closed session counted again: %v", third)
+	}
+
+	// restored usage is reported with the next snapshot, once
+	u.usage.Restore(third)
+	transfer(t, alice, 200)
+	aliceBytes = u.close(t, alice)
+	fourth := u.usage.Snapshot(u.Sessions)
+	if first["alice"]+fourth["alice"] != aliceBytes {
+		t.Fatalf("bad: %v, closed at %d", fourth, aliceBytes)
+	}
+	if last := u.usage.Snapshot(u.Sessions); len(last) != 0 {
+		t.Fatalf("bad: %v", last)
+	}
+}
+
+func TestUsageAggregator_ConcurrentClose(t *testing.T) {
+	u := newUsageServer(t)
+	var conns []net.Conn
+	for i := 0; i < 10; i++ {
+		conn := u.dial(t, "alice")
+		transfer(t, conn, 100)
+		conns = append(conns, conn)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// sessions close while snapshots are taken, and none is lost or
+	// counted twice
+	for _, conn := range conns {
+		go conn.Close()
+	}
+	var snapshots, total int64
+	deadline := time.After(5 * time.Second)
+	for closed := 0; closed < len(conns); {
+		select {
+		case s := <-u.closed:
+			total += sessionBytes(s)
+			closed++
+		case <-deadline:
+			t.Fatalf("sessions not closed")
+		default:
+		}
+		snapshots += u.usage.Snapshot(u.Sessions)["alice"]
+	}
+	snapshots += u.usage.Snapshot(u.Sessions)["alice"]
+	if snapshots != total {
+		t.Fatalf("bad: %d, expected %d", snapshots, total)
+	}
+}
+
+// accountingServer is a RADIUS server accepting every user and
+// recording the octets of stop records per user, failing the user in
+// fail
+type accountingServer struct {
+	mu     sync.Mutex
+	octets map[string]int64
+	fail   atomic.Value
+}
+
+func newAccountingServer(t *testing.T, secret []byte) (*accountingServer, string) {
+	a := &accountingServer{octets: make(map[string]int64)}
+	a.fail.Store("")
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	server := &radius.PacketServer{
+		SecretSource: radius.StaticSecretSource(secret),
+		Handler: radius.HandlerFunc(func(w radius.ResponseWriter, r *radius.Request) {
+			user := rfc2865.UserName_GetString(r.Packet)
+			if user == a.fail.Load().(string) {
+				w.Write(r.Response(radius.CodeAccessReject))
+				return
+			}
+			if r.Code == radius.CodeAccessRequest {
+				w.Write(r.Response(radius.CodeAccessAccept))
+				return
+			}
+			if rfc2866.AcctStatusType_Get(r.Packet) == rfc2866.AcctStatusType_Value_Stop {
+				a.mu.Lock()
+				a.octets[user] += int64(rfc2866.AcctOutputOctets_Get(r.Packet))
+				a.mu.Unlock()
+			}
+			w.Write(r.Response(radius.CodeAccountingResponse))
+		}),
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() { conn.Close() })
+	return a, conn.LocalAddr().String()
+}
+
+func TestRadiusCredentials_AccountingRestore(t *testing.T) {
+	u := newUsageServer(t)
+	secret := []byte("testing123")
+	a, addr := newAccountingServer(t, secret)
+	r := &RadiusCredentials{AccountingServer: addr, Secret: secret, NASIdentifier: "ganted"}
+
+	alice := u.dial(t, "alice")
+	bob := u.dial(t, "bob")
+	transfer(t, alice, 1000)
+	transfer(t, bob, 1000)
+	u.settled(t, "alice")
+	u.settled(t, "bob")
+
+	// bob's usage is kept when sending it fails
+	a.fail.Store("bob")
+	if err := r.accounting(u.usage, u.Sessions); err == nil {
+		t.Fatalf("expected error")
+	}
+	transfer(t, bob, 500)
+	aliceBytes, bobBytes := u.close(t, alice), u.close(t, bob)
+	a.fail.Store("")
+	if err := r.accounting(u.usage, u.Sessions); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.octets["alice"] != aliceBytes || a.octets["bob"] != bobBytes {
+		t.Fatalf("bad: %v, expected alice %d and bob %d", a.octets, aliceBytes, bobBytes)
+	}
+}